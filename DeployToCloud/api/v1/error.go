@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -34,3 +35,162 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrNoCommittedOffset struct {
+	Group string
+}
+
+func (e ErrNoCommittedOffset) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("no committed offset: %s", e.Group),
+	)
+	msg := fmt.Sprintf(
+		"The consumer group hasn't committed an offset: %s",
+		e.Group,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNoCommittedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned to a write sent to a server that doesn't lead
+// the partition, e.g. because leadership moved since the client resolved
+// the servers. The write wasn't applied, so it can be retried once the
+// client has resolved the new leader. Its status is Unavailable with an
+// ErrorInfo detail whose reason is NotLeaderReason, which IsNotLeader
+// checks for.
+type ErrNotLeader struct {
+	Partition uint32
+}
+
+// NotLeaderReason is the reason of ErrNotLeader's ErrorInfo detail.
+const NotLeaderReason = "NOT_LEADER"
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.Unavailable,
+		fmt.Sprintf("not the leader of partition: %d", e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"The server doesn't lead the partition, retry on its leader: %d",
+		e.Partition,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: NotLeaderReason,
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"partition": fmt.Sprintf("%d", e.Partition),
+		},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// IsNotLeader reports whether the error is an ErrNotLeader, returned by the
+// server or received by a client.
+func IsNotLeader(err error) bool {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok &&
+			info.Reason == NotLeaderReason {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrDuplicateSequence is returned when an idempotent producer appends a
+// sequence before its last one again. The record was appended by an
+// earlier attempt, but its offset is no longer known.
+type ErrDuplicateSequence struct {
+	ProducerID string
+	Sequence   uint64
+}
+
+func (e ErrDuplicateSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf(
+			"duplicate sequence: %s %d",
+			e.ProducerID,
+			e.Sequence,
+		),
+	)
+	msg := fmt.Sprintf(
+		"The producer's sequence was already appended: %s %d",
+		e.ProducerID,
+		e.Sequence,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrDuplicateSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOutOfOrderSequence is returned when an idempotent producer skips
+// sequences, the records in between were never appended.
+type ErrOutOfOrderSequence struct {
+	ProducerID string
+	Sequence   uint64
+	Expected   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"out of order sequence: %s %d, expected %d",
+			e.ProducerID,
+			e.Sequence,
+			e.Expected,
+		),
+	)
+	msg := fmt.Sprintf(
+		"The producer skipped sequences, the next one is: %s %d",
+		e.ProducerID,
+		e.Expected,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
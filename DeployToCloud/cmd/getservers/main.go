@@ -28,4 +28,16 @@ func main() {
 	for _, server := range res.Servers {
 		fmt.Printf("\t- %v\n", server)
 	}
+	members, err := client.ListMembers(ctx, &api.ListMembersRequest{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("members:")
+	for _, m := range members.Members {
+		fmt.Printf(
+			"\t- %s %s status=%s raft=%s version=%s role=%s zone=%s capacity=%d\n",
+			m.Name, m.RpcAddr, m.Status, m.RaftRole,
+			m.Version, m.Role, m.Zone, m.Capacity,
+		)
+	}
 }
@@ -6,6 +6,7 @@ import (
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -14,6 +15,9 @@ import (
 	"github.com/igor-baiborodine/proglog/internal/config"
 )
 
+// version is set at build time with -ldflags "-X main.version=<version>".
+var version = "dev"
+
 func main() {
 	cli := &cli{}
 
@@ -66,6 +70,45 @@ func setupFlags(cmd *cobra.Command) error {
 		nil,
 		"Serf addresses to join.")
 	cmd.Flags().Bool("bootstrap", false, "Bootstrap the cluster.")
+	cmd.Flags().Int("partitions",
+		1,
+		"Number of partitions, each with its own Raft group.")
+	cmd.Flags().Int("raft-transport-max-pool",
+		5,
+		"Connections to each Raft peer kept open for reuse.")
+	cmd.Flags().Duration("raft-transport-timeout",
+		10*time.Second,
+		"Timeout for Raft's reads and writes to its peers.")
+	cmd.Flags().Int("raft-snapshot-retain",
+		1,
+		"Number of Raft snapshots kept on disk.")
+	cmd.Flags().Duration("raft-apply-timeout",
+		10*time.Second,
+		"Timeout to replicate a write whose request has no deadline.")
+	cmd.Flags().Uint64("raft-promotion-lag",
+		64,
+		"Entries a joining server may trail the leader by to become a voter.")
+	cmd.Flags().Duration("reconnect-timeout",
+		24*time.Hour,
+		"Time a failed server is kept in the cluster before it's removed.")
+	cmd.Flags().StringSlice("encrypt-keys",
+		nil,
+		"Base64 encoded keys encrypting the gossip, the first is the primary.")
+	cmd.Flags().String("keyring-file",
+		"",
+		"File keeping the rotated gossip keys, defaults to the data dir.")
+	cmd.Flags().String("membership-secret",
+		"",
+		"Secret signing the token servers need to join the cluster.")
+	cmd.Flags().String("role",
+		"server",
+		"Role advertised to the cluster.")
+	cmd.Flags().String("zone",
+		"",
+		"Zone advertised to the cluster.")
+	cmd.Flags().Duration("drain-timeout",
+		10*time.Second,
+		"Time to hand off leadership and leave the cluster on shutdown.")
 
 	cmd.Flags().String("acl-model-file", "", "Path to ACL model.")
 	cmd.Flags().String("acl-policy-file", "", "Path to ACL policy.")
@@ -107,6 +150,20 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
 	c.cfg.RPCPort = viper.GetInt("rpc-port")
 	c.cfg.StartJoinAddrs = viper.GetStringSlice("start-join-addrs")
 	c.cfg.Bootstrap = viper.GetBool("bootstrap")
+	c.cfg.Partitions = viper.GetInt("partitions")
+	c.cfg.RaftTransportMaxPool = viper.GetInt("raft-transport-max-pool")
+	c.cfg.RaftTransportTimeout = viper.GetDuration("raft-transport-timeout")
+	c.cfg.RaftSnapshotRetain = viper.GetInt("raft-snapshot-retain")
+	c.cfg.RaftApplyTimeout = viper.GetDuration("raft-apply-timeout")
+	c.cfg.RaftPromotionLag = viper.GetUint64("raft-promotion-lag")
+	c.cfg.ReconnectTimeout = viper.GetDuration("reconnect-timeout")
+	c.cfg.EncryptKeys = viper.GetStringSlice("encrypt-keys")
+	c.cfg.KeyringFile = viper.GetString("keyring-file")
+	c.cfg.MembershipSecret = viper.GetString("membership-secret")
+	c.cfg.Version = version
+	c.cfg.Role = viper.GetString("role")
+	c.cfg.Zone = viper.GetString("zone")
+	c.cfg.DrainTimeout = viper.GetDuration("drain-timeout")
 	c.cfg.ACLModelFile = viper.GetString("acl-mode-file")
 	c.cfg.ACLPolicyFile = viper.GetString("acl-policy-file")
 	c.cfg.ServerTLSConfig.CertFile = viper.GetString("server-tls-cert-file")
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+	"github.com/igor-baiborodine/proglog/internal/config"
+)
+
+func main() {
+	cli := &cli{}
+
+	cmd := &cobra.Command{
+		Use:               "proglogctl",
+		Short:             "Administer a proglog cluster.",
+		PersistentPreRunE: cli.setupClient,
+		PersistentPostRun: cli.close,
+	}
+	cmd.PersistentFlags().StringVar(&cli.addr, "addr", ":8400",
+		"Address of the server to administer.")
+	cmd.PersistentFlags().StringVar(&cli.tlsConfig.CertFile,
+		"tls-cert-file", "", "Path to client tls cert.")
+	cmd.PersistentFlags().StringVar(&cli.tlsConfig.KeyFile,
+		"tls-key-file", "", "Path to client tls key.")
+	cmd.PersistentFlags().StringVar(&cli.tlsConfig.CAFile,
+		"tls-ca-file", "", "Path to certificate authority.")
+	cmd.PersistentFlags().DurationVar(&cli.timeout, "timeout",
+		30*time.Second, "Timeout for the admin request.")
+	cmd.PersistentFlags().Uint32Var(&cli.partition, "partition", 0,
+		"Partition whose Raft group to administer.")
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "transfer-leadership [id rpc-addr]",
+			Short: "Transfer leadership to a follower.",
+			Args: func(cmd *cobra.Command, args []string) error {
+				if len(args) != 0 && len(args) != 2 {
+					return fmt.Errorf("accepts 0 or 2 arg(s), received %d",
+						len(args))
+				}
+				return nil
+			},
+			RunE: cli.transferLeadership,
+		},
+		&cobra.Command{
+			Use:   "remove-server id",
+			Short: "Remove a server from the Raft configuration.",
+			Args:  cobra.ExactArgs(1),
+			RunE:  cli.removeServer,
+		},
+		&cobra.Command{
+			Use:   "add-voter id rpc-addr",
+			Short: "Add a voting server to the Raft configuration.",
+			Args:  cobra.ExactArgs(2),
+			RunE:  cli.addVoter,
+		},
+		&cobra.Command{
+			Use:   "add-nonvoter id rpc-addr",
+			Short: "Add a non-voting server to the Raft configuration.",
+			Args:  cobra.ExactArgs(2),
+			RunE:  cli.addNonvoter,
+		},
+		&cobra.Command{
+			Use:   "snapshot",
+			Short: "Take a Raft snapshot now.",
+			Args:  cobra.NoArgs,
+			RunE:  cli.snapshot,
+		},
+		&cobra.Command{
+			Use:   "stats",
+			Short: "Print the server's Raft stats.",
+			Args:  cobra.NoArgs,
+			RunE:  cli.stats,
+		},
+		&cobra.Command{
+			Use:   "install-key key",
+			Short: "Install a base64 encoded gossip key on every member.",
+			Args:  cobra.ExactArgs(1),
+			RunE:  cli.installKey,
+		},
+		&cobra.Command{
+			Use:   "use-key key",
+			Short: "Make an installed gossip key every member's primary key.",
+			Args:  cobra.ExactArgs(1),
+			RunE:  cli.useKey,
+		},
+		&cobra.Command{
+			Use:   "remove-key key",
+			Short: "Remove a gossip key from every member.",
+			Args:  cobra.ExactArgs(1),
+			RunE:  cli.removeKey,
+		},
+		&cobra.Command{
+			Use:   "list-keys",
+			Short: "List the gossip keys and how many members have them.",
+			Args:  cobra.NoArgs,
+			RunE:  cli.listKeys,
+		},
+	)
+
+	if err := cmd.Execute(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type cli struct {
+	addr      string
+	tlsConfig config.TLSConfig
+	timeout   time.Duration
+	partition uint32
+
+	conn   *grpc.ClientConn
+	client api.AdminClient
+}
+
+func (c *cli) setupClient(cmd *cobra.Command, args []string) error {
+	tlsConfig, err := config.SetupTLSConfig(c.tlsConfig)
+	if err != nil {
+		return err
+	}
+	creds := credentials.NewTLS(tlsConfig)
+	c.conn, err = grpc.Dial(c.addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	c.client = api.NewAdminClient(c.conn)
+	return nil
+}
+
+func (c *cli) close(cmd *cobra.Command, args []string) {
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+}
+
+func (c *cli) context(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(cmd.Context(), c.timeout)
+}
+
+func (c *cli) transferLeadership(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	req := &api.TransferLeadershipRequest{Partition: c.partition}
+	if len(args) == 2 {
+		req.Id, req.RpcAddr = args[0], args[1]
+	}
+	if _, err := c.client.TransferLeadership(ctx, req); err != nil {
+		return err
+	}
+	fmt.Println("leadership transferred")
+	return nil
+}
+
+func (c *cli) removeServer(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	_, err := c.client.RemoveServer(ctx, &api.RemoveServerRequest{
+		Id:        args[0],
+		Partition: c.partition,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed server %s\n", args[0])
+	return nil
+}
+
+func (c *cli) addVoter(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	_, err := c.client.AddVoter(ctx, &api.AddServerRequest{
+		Id:        args[0],
+		RpcAddr:   args[1],
+		Partition: c.partition,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added voter %s at %s\n", args[0], args[1])
+	return nil
+}
+
+func (c *cli) addNonvoter(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	_, err := c.client.AddNonvoter(ctx, &api.AddServerRequest{
+		Id:        args[0],
+		RpcAddr:   args[1],
+		Partition: c.partition,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added nonvoter %s at %s\n", args[0], args[1])
+	return nil
+}
+
+func (c *cli) snapshot(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	res, err := c.client.Snapshot(ctx, &api.SnapshotRequest{
+		Partition: c.partition,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot %s (index: %d, term: %d)\n",
+		res.Id, res.Index, res.Term)
+	return nil
+}
+
+func (c *cli) stats(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	res, err := c.client.RaftStats(ctx, &api.RaftStatsRequest{
+		Partition: c.partition,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("state:          %s\n", res.State)
+	fmt.Printf("leader:         %s\n", res.LeaderId)
+	fmt.Printf("term:           %d\n", res.Term)
+	fmt.Printf("commit index:   %d\n", res.CommitIndex)
+	fmt.Printf("applied index:  %d\n", res.AppliedIndex)
+	fmt.Printf("last log index: %d\n", res.LastLogIndex)
+	fmt.Println("peers:")
+	for _, peer := range res.Peers {
+		lastContact := "unknown"
+		if peer.LastContact != 0 {
+			lastContact = time.Since(
+				time.Unix(0, peer.LastContact),
+			).Round(time.Millisecond).String() + " ago"
+		}
+		fmt.Printf("\t- %s %s (%s) last contact: %s, failing: %t\n",
+			peer.Id, peer.RpcAddr, peer.Suffrage, lastContact, peer.Failing)
+	}
+	return nil
+}
+
+func (c *cli) installKey(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	_, err := c.client.InstallKey(ctx, &api.KeyRequest{Key: args[0]})
+	if err != nil {
+		return err
+	}
+	fmt.Println("installed key")
+	return nil
+}
+
+func (c *cli) useKey(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	_, err := c.client.UseKey(ctx, &api.KeyRequest{Key: args[0]})
+	if err != nil {
+		return err
+	}
+	fmt.Println("using key")
+	return nil
+}
+
+func (c *cli) removeKey(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	_, err := c.client.RemoveKey(ctx, &api.KeyRequest{Key: args[0]})
+	if err != nil {
+		return err
+	}
+	fmt.Println("removed key")
+	return nil
+}
+
+func (c *cli) listKeys(cmd *cobra.Command, args []string) error {
+	ctx, cancel := c.context(cmd)
+	defer cancel()
+	res, err := c.client.ListKeys(ctx, &api.ListKeysRequest{})
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(res.Keys))
+	for key := range res.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s (members: %d)\n", key, res.Keys[key])
+	}
+	return nil
+}
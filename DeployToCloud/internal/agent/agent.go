@@ -3,14 +3,18 @@ package agent
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/soheilhy/cmux"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
@@ -36,6 +40,42 @@ type Config struct {
 	ACLModelFile   string
 	ACLPolicyFile  string
 	Bootstrap      bool
+	// Partitions is the number of partitions the log is split into, each
+	// with its own Raft group.
+	Partitions int
+	// RaftTransportMaxPool is how many connections to each peer Raft keeps
+	// open for reuse.
+	RaftTransportMaxPool int
+	// RaftTransportTimeout bounds Raft's reads and writes to its peers.
+	RaftTransportTimeout time.Duration
+	// RaftSnapshotRetain is how many Raft snapshots are kept on disk.
+	RaftSnapshotRetain int
+	// RaftApplyTimeout bounds replicating a write whose request has no
+	// deadline.
+	RaftApplyTimeout time.Duration
+	// RaftPromotionLag is how many entries a joining server may trail the
+	// leader by before it's promoted from nonvoter to voter.
+	RaftPromotionLag uint64
+	// ReconnectTimeout is how long a failed server is kept in the cluster
+	// before it's removed.
+	ReconnectTimeout time.Duration
+	// EncryptKeys are the base64 encoded keys that encrypt the gossip
+	// between servers, the first key is the primary key.
+	EncryptKeys []string
+	// KeyringFile keeps the gossip keys rotated since the server started,
+	// it defaults to keyring.json in the DataDir.
+	KeyringFile string
+	// MembershipSecret signs the token servers must have to join the
+	// cluster.
+	MembershipSecret string
+	// Version, Role and Zone are advertised to the cluster with the free
+	// capacity of the DataDir.
+	Version string
+	Role    string
+	Zone    string
+	// DrainTimeout bounds how long shutdown waits to hand off leadership
+	// and be removed from the cluster before stopping.
+	DrainTimeout time.Duration
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -50,9 +90,10 @@ type Agent struct {
 	Config Config
 
 	mux        cmux.CMux
-	log        *log.DistributedLog
+	log        *log.PartitionedLog
 	server     *grpc.Server
 	membership *discovery.Membership
+	logger     *zap.Logger
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -60,15 +101,24 @@ type Agent struct {
 }
 
 func New(config Config) (*Agent, error) {
+	if config.Partitions == 0 {
+		config.Partitions = 1
+	}
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = 10 * time.Second
+	}
 	a := &Agent{
 		Config:    config,
 		shutdowns: make(chan struct{}),
+		logger:    zap.L().Named("agent"),
 	}
+	// the membership is set up before the server so the server's handlers
+	// never see it unset
 	setup := []func() error{
 		a.setupMux,
 		a.setupLog,
-		a.setupServer,
 		a.setupMembership,
+		a.setupServer,
 	}
 	for _, fn := range setup {
 		if err := fn(); err != nil {
@@ -115,10 +165,16 @@ func (a *Agent) setupLog() error {
 	logConfig.Raft.BindAddr = rpcAddr
 	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
+	logConfig.Raft.TransportMaxPool = a.Config.RaftTransportMaxPool
+	logConfig.Raft.TransportTimeout = a.Config.RaftTransportTimeout
+	logConfig.Raft.SnapshotRetain = a.Config.RaftSnapshotRetain
+	logConfig.Raft.ApplyTimeout = a.Config.RaftApplyTimeout
+	logConfig.Raft.PromotionLag = a.Config.RaftPromotionLag
 
-	a.log, err = log.NewDistributedLog(
+	a.log, err = log.NewPartitionedLog(
 		a.Config.DataDir,
 		logConfig,
+		a.Config.Partitions,
 	)
 	if err != nil {
 		return err
@@ -134,10 +190,21 @@ func (a *Agent) setupServer() error {
 		a.Config.ACLModelFile,
 		a.Config.ACLPolicyFile,
 	)
+	// the other partitions' logs serve their own offsets, watches and
+	// admin calls
+	metadata := a.log.Partitions()[0]
 	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+		CommitLog:      metadata,
+		Authorizer:     authorizer,
+		GetServerer:    a,
+		MemberLister:   a,
+		ClusterWatcher: metadata,
+		OffsetStore:    metadata,
+		Administrator:  metadata,
+		Keyring:        a,
+	}
+	for _, l := range a.log.Partitions() {
+		serverConfig.Partitions = append(serverConfig.Partitions, l)
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -166,14 +233,30 @@ func (a *Agent) setupMembership() error {
 	if err != nil {
 		return err
 	}
-	a.membership, err = discovery.New(a.log, discovery.Config{
-		NodeName: a.Config.NodeName,
-		BindAddr: a.Config.BindAddr,
-		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
-		},
-		StartJoinAddrs: a.Config.StartJoinAddrs,
-	})
+	config := discovery.Config{
+		NodeName:         a.Config.NodeName,
+		BindAddr:         a.Config.BindAddr,
+		Tags:             a.tags(rpcAddr),
+		StartJoinAddrs:   a.Config.StartJoinAddrs,
+		ReconnectTimeout: a.Config.ReconnectTimeout,
+	}
+	for _, encoded := range a.Config.EncryptKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid encrypt key: %w", err)
+		}
+		config.EncryptKeys = append(config.EncryptKeys, key)
+	}
+	if len(config.EncryptKeys) != 0 {
+		config.KeyringFile = a.Config.KeyringFile
+		if config.KeyringFile == "" {
+			config.KeyringFile = filepath.Join(a.Config.DataDir, "keyring.json")
+		}
+	}
+	if a.Config.MembershipSecret != "" {
+		config.Secret = []byte(a.Config.MembershipSecret)
+	}
+	a.membership, err = discovery.New(a.log, config)
 	return err
 }
 
@@ -199,10 +282,20 @@ func (a *Agent) Shutdown() error {
 	a.shutdown = true
 	close(a.shutdowns)
 
+	deadline := time.Now().Add(a.Config.DrainTimeout)
 	shutdown := []func() error{
+		a.handoffLeadership,
 		a.membership.Leave,
 		func() error {
-			a.server.GracefulStop()
+			// the server stops either way, the leaders remove it once
+			// they see it's gone
+			if err := a.waitForRemoval(time.Until(deadline)); err != nil {
+				a.logger.Warn("failed to leave raft cluster", zap.Error(err))
+			}
+			return nil
+		},
+		func() error {
+			a.stopServer(time.Until(deadline))
 			return nil
 		},
 		a.log.Close,
@@ -214,3 +307,58 @@ func (a *Agent) Shutdown() error {
 	}
 	return nil
 }
+
+// handoffLeadership transfers leadership of the partitions this agent leads
+// to their most caught-up followers so the cluster doesn't sit leaderless
+// for an election timeout once this agent stops.
+func (a *Agent) handoffLeadership() error {
+	for i, l := range a.log.Partitions() {
+		if !l.IsLeader() {
+			continue
+		}
+		hasPeers, err := l.HasPeers()
+		if err != nil || !hasPeers {
+			continue
+		}
+		if err = l.TransferLeadership("", ""); err != nil {
+			a.logger.Warn(
+				"failed to transfer leadership",
+				zap.Int("partition", i),
+				zap.Error(err),
+			)
+		}
+	}
+	return nil
+}
+
+// stopServer lets the in-flight calls finish, and stops the server outright
+// when the timeout passes, since streams like the resolvers' cluster watches
+// never finish on their own.
+func (a *Agent) stopServer(timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		a.server.GracefulStop()
+		close(stopped)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		a.server.Stop()
+		<-stopped
+	}
+}
+
+// waitForRemoval waits for the new leaders to remove this agent from the
+// partitions' Raft configurations after it left the serf cluster.
+func (a *Agent) waitForRemoval(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var errs []error
+	for i, l := range a.log.Partitions() {
+		if err := l.WaitForRemoval(time.Until(deadline)); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -11,7 +11,9 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	api "github.com/igor-baiborodine/proglog/api/v1"
 	"github.com/igor-baiborodine/proglog/internal/agent"
@@ -112,6 +114,274 @@ func TestAgent(t *testing.T) {
 	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
 }
 
+func TestAgentShutdownHandsOffLeadership(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *agent.Config) {
+		c.DrainTimeout = 3 * time.Second
+	})
+
+	// wait until agents have joined the cluster
+	time.Sleep(3 * time.Second)
+
+	start := time.Now()
+	require.NoError(t, agents[0].Shutdown())
+	require.Less(t, time.Since(start), 3*time.Second)
+
+	// leadership was handed off before the old leader stopped, so the
+	// cluster has a leader without waiting for an election
+	var stats *api.RaftStatsResponse
+	for _, a := range agents[1:] {
+		res, err := adminClient(t, a, peerTLSConfig).RaftStats(
+			context.Background(),
+			&api.RaftStatsRequest{},
+		)
+		require.NoError(t, err)
+		if res.State == "Leader" {
+			stats = res
+		}
+	}
+	require.NotNil(t, stats)
+	require.Equal(t, 2, len(stats.Peers))
+	for _, peer := range stats.Peers {
+		require.NotEqual(t, "0", peer.Id)
+	}
+}
+
+func TestAgentPartitions(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *agent.Config) {
+		c.Partitions = 3
+	})
+
+	serversClient := api.NewLogClient(dial(t, agents[0], peerTLSConfig))
+	require.Eventually(t, func() bool {
+		res, err := serversClient.GetServers(
+			context.Background(),
+			&api.GetServersRequest{},
+		)
+		if err != nil || len(res.Servers) != 3 {
+			return false
+		}
+		for _, server := range res.Servers {
+			if len(server.LeaderPartitions) != 1 {
+				return false
+			}
+		}
+		return true
+	}, 20*time.Second, 500*time.Millisecond)
+
+	// the client resolves the partitions' leaders when it's created
+	partitionClient := client(t, agents[1], peerTLSConfig)
+	for i := uint32(0); i < 3; i++ {
+		ctx := loadbalance.WithPartition(context.Background(), i)
+		res, err := partitionClient.Produce(ctx, &api.ProduceRequest{
+			Record:    &api.Record{Value: []byte("foo")},
+			Partition: i,
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), res.Offset)
+
+		require.Eventually(t, func() bool {
+			res, err := partitionClient.Consume(ctx, &api.ConsumeRequest{
+				Offset:    res.Offset,
+				Partition: i,
+			})
+			return err == nil && string(res.Record.Value) == "foo"
+		}, 3*time.Second, 100*time.Millisecond)
+	}
+
+	// the admin calls reach the partition's own Raft group
+	admin := adminClient(t, agents[0], peerTLSConfig)
+	for i := uint32(0); i < 3; i++ {
+		stats, err := admin.RaftStats(
+			context.Background(),
+			&api.RaftStatsRequest{Partition: i},
+		)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(stats.Peers))
+		require.Equal(t, fmt.Sprintf("%d", i), stats.LeaderId)
+	}
+	_, err := admin.RaftStats(
+		context.Background(),
+		&api.RaftStatsRequest{Partition: 3},
+	)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAgentListMembers(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *agent.Config) {
+		c.Version = "v1.2.3"
+		c.Role = "server"
+		c.Zone = "zone-" + c.NodeName
+	})
+
+	membersClient := api.NewLogClient(dial(t, agents[0], peerTLSConfig))
+	var members []*api.Member
+	require.Eventually(t, func() bool {
+		res, err := membersClient.ListMembers(
+			context.Background(),
+			&api.ListMembersRequest{},
+		)
+		if err != nil || len(res.Members) != 3 {
+			return false
+		}
+		for _, m := range res.Members {
+			if m.RaftRole != "leader" && m.RaftRole != "voter" {
+				return false
+			}
+		}
+		members = res.Members
+		return true
+	}, 10*time.Second, 250*time.Millisecond)
+
+	for i, m := range members {
+		rpcAddr, err := agents[i].Config.RPCAddr()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%d", i), m.Name)
+		require.Equal(t, rpcAddr, m.RpcAddr)
+		require.Equal(t, "alive", m.Status)
+		require.Equal(t, "v1.2.3", m.Version)
+		require.Equal(t, "server", m.Role)
+		require.Equal(t, fmt.Sprintf("zone-%d", i), m.Zone)
+		require.NotZero(t, m.Capacity)
+	}
+	require.Equal(t, "leader", members[0].RaftRole)
+
+	// the servers carry their zones to the clients' resolvers
+	res, err := membersClient.GetServers(
+		context.Background(),
+		&api.GetServersRequest{},
+	)
+	require.NoError(t, err)
+	for _, server := range res.Servers {
+		require.Equal(t, "zone-"+server.Id, server.Zone)
+	}
+}
+
+func TestAgentRotatesGossipKey(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, nil)
+	oldKey := "MDEyMzQ1Njc4OWFiY2RlZg=="
+	newKey := "ZmVkY2JhOTg3NjU0MzIxMA=="
+
+	listKeys := func(a *agent.Agent) map[string]int32 {
+		res, err := adminClient(t, a, peerTLSConfig).ListKeys(
+			context.Background(),
+			&api.ListKeysRequest{},
+		)
+		require.NoError(t, err)
+		return res.Keys
+	}
+	require.Eventually(t, func() bool {
+		return listKeys(agents[0])[oldKey] == 3
+	}, 10*time.Second, 250*time.Millisecond)
+
+	// any member rotates the key on every member
+	_, err := adminClient(t, agents[1], peerTLSConfig).InstallKey(
+		context.Background(),
+		&api.KeyRequest{Key: newKey},
+	)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		map[string]int32{oldKey: 3, newKey: 3},
+		listKeys(agents[0]),
+	)
+
+	admin := adminClient(t, agents[2], peerTLSConfig)
+	_, err = admin.UseKey(context.Background(), &api.KeyRequest{Key: newKey})
+	require.NoError(t, err)
+	// the primary key can't be removed
+	_, err = admin.RemoveKey(
+		context.Background(),
+		&api.KeyRequest{Key: newKey},
+	)
+	require.Error(t, err)
+	_, err = admin.RemoveKey(
+		context.Background(),
+		&api.KeyRequest{Key: oldKey},
+	)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int32{newKey: 3}, listKeys(agents[0]))
+
+	// the members keep gossiping with the new key
+	res, err := api.NewLogClient(dial(t, agents[0], peerTLSConfig)).ListMembers(
+		context.Background(),
+		&api.ListMembersRequest{},
+	)
+	require.NoError(t, err)
+	require.Len(t, res.Members, 3)
+	for _, m := range res.Members {
+		require.Equal(t, "alive", m.Status)
+	}
+}
+
+func setupAgents(t *testing.T, count int, fn func(*agent.Config)) (
+	agents []*agent.Agent,
+	peerTLSConfig *tls.Config,
+) {
+	t.Helper()
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err = config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < count; i++ {
+		ports := dynaport.Get(2)
+		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+		rpcPort := ports[1]
+
+		dataDir, err := os.MkdirTemp("", "agent-test-log")
+		require.NoError(t, err)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
+		}
+
+		agentConfig := agent.Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			Bootstrap:       i == 0,
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        bindAddr,
+			RPCPort:         rpcPort,
+			DataDir:         dataDir,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			// every agent gossips encrypted and needs the secret's token
+			EncryptKeys:      []string{"MDEyMzQ1Njc4OWFiY2RlZg=="},
+			MembershipSecret: "secret",
+		}
+		if fn != nil {
+			fn(&agentConfig)
+		}
+		a, err := agent.New(agentConfig)
+		require.NoError(t, err)
+
+		agents = append(agents, a)
+	}
+	t.Cleanup(func() {
+		for _, a := range agents {
+			_ = a.Shutdown()
+			require.NoError(t, os.RemoveAll(a.Config.DataDir))
+		}
+	})
+	return agents, peerTLSConfig
+}
+
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
 	tlsCreds := credentials.NewTLS(tlsConfig)
 	opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
@@ -123,6 +393,31 @@ func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClie
 		rpcAddr,
 	), opts...)
 	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
 	client := api.NewLogClient(conn)
 	return client
 }
+
+func adminClient(
+	t *testing.T,
+	agent *agent.Agent,
+	tlsConfig *tls.Config,
+) api.AdminClient {
+	return api.NewAdminClient(dial(t, agent, tlsConfig))
+}
+
+// dial connects to the agent without the loadbalance resolver.
+func dial(
+	t *testing.T,
+	agent *agent.Agent,
+	tlsConfig *tls.Config,
+) *grpc.ClientConn {
+	tlsCreds := credentials.NewTLS(tlsConfig)
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
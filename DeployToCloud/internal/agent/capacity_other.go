@@ -0,0 +1,9 @@
+//go:build !unix
+
+package agent
+
+import "errors"
+
+func diskCapacity(string) (uint64, error) {
+	return 0, errors.New("disk capacity not supported")
+}
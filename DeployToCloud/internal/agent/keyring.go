@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// InstallKey adds the base64 encoded key to every member's gossip keyring.
+// To rotate the key, install the new key, use it and then remove the old
+// one.
+func (a *Agent) InstallKey(key string) error {
+	if err := a.checkEncrypted(); err != nil {
+		return err
+	}
+	return a.membership.InstallKey(key)
+}
+
+// UseKey makes the installed key every member's primary key, the key the
+// members encrypt their gossip with.
+func (a *Agent) UseKey(key string) error {
+	if err := a.checkEncrypted(); err != nil {
+		return err
+	}
+	return a.membership.UseKey(key)
+}
+
+// RemoveKey removes the key from every member's keyring.
+func (a *Agent) RemoveKey(key string) error {
+	if err := a.checkEncrypted(); err != nil {
+		return err
+	}
+	return a.membership.RemoveKey(key)
+}
+
+// ListKeys returns the keys installed on the members and how many members
+// have each of them.
+func (a *Agent) ListKeys() (map[string]int, error) {
+	if err := a.checkEncrypted(); err != nil {
+		return nil, err
+	}
+	return a.membership.ListKeys()
+}
+
+// checkEncrypted fails the key calls when the gossip isn't encrypted, the
+// cluster has no keyring to rotate then.
+func (a *Agent) checkEncrypted() error {
+	if a.membership == nil {
+		return status.Error(codes.Unavailable, "membership not set up")
+	}
+	if len(a.Config.EncryptKeys) == 0 {
+		return status.Error(
+			codes.FailedPrecondition,
+			"gossip encryption not enabled",
+		)
+	}
+	return nil
+}
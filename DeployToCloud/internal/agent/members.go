@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+)
+
+// The serf tags each server advertises.
+const (
+	rpcAddrTag  = "rpc_addr"
+	versionTag  = "version"
+	roleTag     = "role"
+	zoneTag     = "zone"
+	capacityTag = "capacity"
+)
+
+// tags returns the serf tags the server advertises to the cluster.
+func (a *Agent) tags(rpcAddr string) map[string]string {
+	tags := map[string]string{
+		rpcAddrTag: rpcAddr,
+		versionTag: a.Config.Version,
+		roleTag:    a.Config.Role,
+		zoneTag:    a.Config.Zone,
+	}
+	if capacity, err := diskCapacity(a.Config.DataDir); err == nil {
+		tags[capacityTag] = strconv.FormatUint(capacity, 10)
+	}
+	return tags
+}
+
+// GetServers returns the Raft servers with the zones they advertise, so
+// clients can prefer servers in their own zone.
+func (a *Agent) GetServers() ([]*api.Server, error) {
+	servers, err := a.log.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	if a.membership == nil {
+		return servers, nil
+	}
+	zones := make(map[string]string)
+	for _, m := range a.membership.Members() {
+		zones[m.Name] = m.Tags[zoneTag]
+	}
+	for _, server := range servers {
+		server.Zone = zones[server.Id]
+	}
+	return servers, nil
+}
+
+// ListMembers joins the gossip's members with the Raft servers, listing
+// the servers known to either of them.
+func (a *Agent) ListMembers() ([]*api.Member, error) {
+	if a.membership == nil {
+		return nil, status.Error(codes.Unavailable, "membership not set up")
+	}
+	servers, err := a.log.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]string)
+	for _, server := range servers {
+		role := server.Suffrage
+		switch {
+		case server.IsLeader:
+			role = "leader"
+		case server.Suffrage == raft.Voter.String():
+			role = "voter"
+		case server.Suffrage == raft.Nonvoter.String():
+			role = "nonvoter"
+		}
+		roles[server.Id] = role
+	}
+	var members []*api.Member
+	for _, m := range a.membership.Members() {
+		capacity, _ := strconv.ParseUint(m.Tags[capacityTag], 10, 64)
+		members = append(members, &api.Member{
+			Name:     m.Name,
+			RpcAddr:  m.Tags[rpcAddrTag],
+			Status:   m.Status.String(),
+			RaftRole: roles[m.Name],
+			Version:  m.Tags[versionTag],
+			Role:     m.Tags[roleTag],
+			Zone:     m.Tags[zoneTag],
+			Capacity: capacity,
+		})
+		delete(roles, m.Name)
+	}
+	for _, server := range servers {
+		if _, ok := roles[server.Id]; !ok {
+			continue
+		}
+		members = append(members, &api.Member{
+			Name:     server.Id,
+			RpcAddr:  server.RpcAddr,
+			RaftRole: roles[server.Id],
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members, nil
+}
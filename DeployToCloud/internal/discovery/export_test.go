@@ -0,0 +1,9 @@
+package discovery
+
+// Shutdown stops the member without leaving, like a crash, so the other
+// members see it fail.
+func (m *Membership) Shutdown() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.serf.Shutdown()
+}
@@ -0,0 +1,97 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// setupKeyring creates the keyring that encrypts the gossip. The keys in
+// the keyring file win over the configured keys since they have the
+// rotations made after the member started. The first key is the primary
+// key, it encrypts the messages, and all the keys decrypt them.
+func (m *Membership) setupKeyring() error {
+	keys := m.EncryptKeys
+	if m.KeyringFile != "" {
+		fileKeys, err := readKeyringFile(m.KeyringFile)
+		if err != nil {
+			return err
+		}
+		if len(fileKeys) != 0 {
+			keys = fileKeys
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	keyring, err := memberlist.NewKeyring(keys, keys[0])
+	if err != nil {
+		return err
+	}
+	m.keyring = keyring
+	return nil
+}
+
+func readKeyringFile(path string) ([][]byte, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var encoded []string
+	if err = json.Unmarshal(b, &encoded); err != nil {
+		return nil, fmt.Errorf("keyring file %s: %w", path, err)
+	}
+	var keys [][]byte
+	for _, s := range encoded {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("keyring file %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// InstallKey adds the base64 encoded key to every member's keyring. To
+// rotate the key, install the new key, use it and then remove the old one.
+func (m *Membership) InstallKey(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.serf.KeyManager().InstallKey(key)
+	return err
+}
+
+// UseKey makes the installed key every member's primary key.
+func (m *Membership) UseKey(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.serf.KeyManager().UseKey(key)
+	return err
+}
+
+// RemoveKey removes the key from every member's keyring, the primary key
+// can't be removed.
+func (m *Membership) RemoveKey(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.serf.KeyManager().RemoveKey(key)
+	return err
+}
+
+// ListKeys returns the base64 encoded keys installed on the members and
+// how many members have each of them.
+func (m *Membership) ListKeys() (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res, err := m.serf.KeyManager().ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	return res.Keys, nil
+}
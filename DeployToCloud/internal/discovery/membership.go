@@ -2,9 +2,12 @@ package discovery
 
 import (
 	"net"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 )
@@ -12,17 +15,27 @@ import (
 type Membership struct {
 	Config
 	handler Handler
-	serf    *serf.Serf
 	events  chan serf.Event
 	logger  *zap.Logger
+	keyring *memberlist.Keyring
+
+	// mu guards serf, Rejoin replaces it.
+	mu   sync.Mutex
+	serf *serf.Serf
 }
 
 func New(handler Handler, config Config) (*Membership, error) {
 	c := &Membership{
 		Config:  config,
 		handler: handler,
+		events:  make(chan serf.Event),
 		logger:  zap.L().Named("membership"),
 	}
+	if err := c.setupKeyring(); err != nil {
+		return nil, err
+	}
+	// the event loop outlives the serf instances Rejoin creates
+	go c.eventHandler() // <label id="handlergoroutine" />
 	if err := c.setupSerf(); err != nil {
 		return nil, err
 	}
@@ -34,6 +47,19 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	// ReconnectTimeout is how long a failed member is kept in the cluster
+	// before it's reaped and removed, so a member that's briefly
+	// unreachable rejoins without being added again. Defaults to serf's.
+	ReconnectTimeout time.Duration
+	// EncryptKeys encrypt the gossip, the first key is the primary key.
+	// Every member needs one of the keys to join.
+	EncryptKeys [][]byte
+	// KeyringFile keeps the keyring across restarts with the keys
+	// installed, used and removed since the member started.
+	KeyringFile string
+	// Secret signs the member's token. When set, members without a token
+	// signed with the same secret aren't joined.
+	Secret []byte
 }
 
 func (m *Membership) setupSerf() (err error) {
@@ -45,17 +71,37 @@ func (m *Membership) setupSerf() (err error) {
 	config.Init()
 	config.MemberlistConfig.BindAddr = addr.IP.String()
 	config.MemberlistConfig.BindPort = addr.Port
-	m.events = make(chan serf.Event)
 	config.EventCh = m.events
-	config.Tags = m.Tags
+	config.Tags = make(map[string]string)
+	for k, v := range m.Tags {
+		config.Tags[k] = v
+	}
+	if m.Secret != nil {
+		config.Tags[tokenTag] = signToken(
+			m.Secret,
+			m.NodeName,
+			m.Tags["rpc_addr"],
+		)
+	}
+	if m.keyring != nil {
+		config.MemberlistConfig.Keyring = m.keyring
+		config.KeyringFile = m.KeyringFile
+	}
 	config.NodeName = m.Config.NodeName
-	m.serf, err = serf.Create(config)
+	if m.ReconnectTimeout != 0 {
+		config.ReconnectTimeout = m.ReconnectTimeout
+		// failed members are only reaped every reap interval
+		if m.ReconnectTimeout < config.ReapInterval {
+			config.ReapInterval = m.ReconnectTimeout
+		}
+	}
+	s, err := serf.Create(config)
 	if err != nil {
 		return err
 	}
-	go m.eventHandler() // <label id="handlergoroutine" />
+	m.serf = s
 	if m.StartJoinAddrs != nil {
-		_, err = m.serf.Join(m.StartJoinAddrs, true)
+		_, err = s.Join(m.StartJoinAddrs, true)
 		if err != nil {
 			return err
 		}
@@ -63,6 +109,21 @@ func (m *Membership) setupSerf() (err error) {
 	return nil
 }
 
+// Rejoin brings back a member that left, or whose serf was shut down, with
+// the same name. Serf can't join again after leaving, so Rejoin replaces it
+// with a new instance that joins the StartJoinAddrs.
+func (m *Membership) Rejoin() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.serf.State() == serf.SerfAlive {
+		return nil
+	}
+	if err := m.serf.Shutdown(); err != nil {
+		return err
+	}
+	return m.setupSerf()
+}
+
 type Handler interface {
 	Join(name, addr string) error
 	Leave(name string) error
@@ -78,10 +139,27 @@ func (m *Membership) eventHandler() {
 				}
 				m.handleJoin(member)
 			}
-		case serf.EventMemberLeave, serf.EventMemberFailed:
+		case serf.EventMemberUpdate:
+			// the member's tags changed, joining again picks up a new
+			// rpc_addr
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
-					return
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberFailed:
+			// keep the member until it's reaped, it may reconnect
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.logger.Warn("member failed", zap.String("name", member.Name))
+			}
+		case serf.EventMemberLeave, serf.EventMemberReap:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
 				}
 				m.handleLeave(member)
 			}
@@ -90,6 +168,14 @@ func (m *Membership) eventHandler() {
 }
 
 func (m *Membership) handleJoin(member serf.Member) {
+	if m.Secret != nil && !validToken(m.Secret, member) {
+		m.logger.Warn(
+			"refused member without a valid token",
+			zap.String("name", member.Name),
+			zap.String("rpc_addr", member.Tags["rpc_addr"]),
+		)
+		return
+	}
 	if err := m.handler.Join(
 		member.Name,
 		member.Tags["rpc_addr"],
@@ -107,14 +193,18 @@ func (m *Membership) handleLeave(member serf.Member) {
 }
 
 func (m *Membership) isLocal(member serf.Member) bool {
-	return m.serf.LocalMember().Name == member.Name
+	return m.NodeName == member.Name
 }
 
 func (m *Membership) Members() []serf.Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.serf.Members()
 }
 
 func (m *Membership) Leave() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.serf.Leave()
 }
 
@@ -1,6 +1,7 @@
 package discovery_test
 
 import (
+	"encoding/base64"
 	"fmt"
 	"testing"
 	"time"
@@ -13,9 +14,9 @@ import (
 )
 
 func TestMembership(t *testing.T) {
-	m, handler := setupMember(t, nil)
-	m, _ = setupMember(t, m)
-	m, _ = setupMember(t, m)
+	m, handler := setupMember(t, nil, nil)
+	m, _ = setupMember(t, m, nil)
+	m, _ = setupMember(t, m, nil)
 
 	require.Eventually(t, func() bool {
 		return 2 == len(handler.joins) &&
@@ -35,7 +36,136 @@ func TestMembership(t *testing.T) {
 	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
 }
 
-func setupMember(t *testing.T, members []*Membership) (
+func TestMembershipFailedMemberReaped(t *testing.T) {
+	reconnect := func(c *Config) {
+		c.ReconnectTimeout = 2 * time.Second
+	}
+	m, handler := setupMember(t, nil, reconnect)
+	m, _ = setupMember(t, m, reconnect)
+
+	require.Eventually(t, func() bool {
+		return 1 == len(handler.joins) && 2 == len(m[0].Members())
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.NoError(t, m[1].Shutdown())
+
+	// the failed member is kept for the reconnect timeout
+	require.Eventually(t, func() bool {
+		for _, member := range m[0].Members() {
+			if member.Name == "1" && member.Status == serf.StatusFailed {
+				return true
+			}
+		}
+		return false
+	}, 20*time.Second, 250*time.Millisecond)
+	require.Equal(t, 0, len(handler.leaves))
+
+	select {
+	case id := <-handler.leaves:
+		require.Equal(t, "1", id)
+	case <-time.After(10 * time.Second):
+		t.Fatal("failed member wasn't reaped")
+	}
+}
+
+func TestMembershipRejoin(t *testing.T) {
+	m, handler := setupMember(t, nil, nil)
+	m, _ = setupMember(t, m, nil)
+	m, rejoined := setupMember(t, m, nil)
+
+	require.Eventually(t, func() bool {
+		return 2 == len(handler.joins) &&
+			3 == len(m[0].Members()) &&
+			2 == len(rejoined.joins)
+	}, 3*time.Second, 250*time.Millisecond)
+	drain(handler.joins)
+	drain(rejoined.joins)
+
+	// the member sees its own leave, its event loop must keep running for
+	// it to rejoin
+	require.NoError(t, m[2].Leave())
+	require.Equal(t, "2", <-handler.leaves)
+
+	require.NoError(t, m[2].Rejoin())
+	require.Eventually(t, func() bool {
+		for _, member := range m[0].Members() {
+			if member.Name == "2" {
+				return member.Status == serf.StatusAlive
+			}
+		}
+		return false
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, "2", (<-handler.joins)["id"])
+	require.Eventually(t, func() bool {
+		return 2 == len(rejoined.joins)
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, 0, len(rejoined.leaves))
+}
+
+func TestMembershipEncryption(t *testing.T) {
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+	encrypt := func(c *Config) {
+		c.EncryptKeys = [][]byte{oldKey}
+	}
+	m, h := setupMember(t, nil, encrypt)
+	m, _ = setupMember(t, m, encrypt)
+	require.Eventually(t, func() bool {
+		return 1 == len(h.joins) && 2 == len(m[0].Members())
+	}, 3*time.Second, 250*time.Millisecond)
+
+	// a member without the key can't join
+	_, err := New(&handler{}, Config{
+		NodeName:       "unencrypted",
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]),
+		StartJoinAddrs: []string{m[0].BindAddr},
+	})
+	require.Error(t, err)
+
+	encoded := base64.StdEncoding.EncodeToString(newKey)
+	require.NoError(t, m[0].InstallKey(encoded))
+	require.NoError(t, m[0].UseKey(encoded))
+	require.NoError(t, m[0].RemoveKey(base64.StdEncoding.EncodeToString(oldKey)))
+	keys, err := m[1].ListKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{encoded: 2}, keys)
+
+	// members with only the new key join
+	m, _ = setupMember(t, m, func(c *Config) {
+		c.EncryptKeys = [][]byte{newKey}
+	})
+	require.Eventually(t, func() bool {
+		return 2 == len(h.joins) && 3 == len(m[0].Members())
+	}, 3*time.Second, 250*time.Millisecond)
+}
+
+func TestMembershipToken(t *testing.T) {
+	secret := func(secret string) func(*Config) {
+		return func(c *Config) {
+			c.Secret = []byte(secret)
+		}
+	}
+	m, handler := setupMember(t, nil, secret("secret"))
+	m, _ = setupMember(t, m, secret("secret"))
+	m, _ = setupMember(t, m, secret("forged"))
+	m, _ = setupMember(t, m, nil)
+
+	require.Eventually(t, func() bool {
+		return 4 == len(m[0].Members())
+	}, 3*time.Second, 250*time.Millisecond)
+	// give the refused members' events time to be handled
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, 1, len(handler.joins))
+	require.Equal(t, "1", (<-handler.joins)["id"])
+}
+
+func drain(joins chan map[string]string) {
+	for len(joins) > 0 {
+		<-joins
+	}
+}
+
+func setupMember(t *testing.T, members []*Membership, fn func(*Config)) (
 	[]*Membership, *handler,
 ) {
 	id := len(members)
@@ -49,11 +179,14 @@ func setupMember(t *testing.T, members []*Membership) (
 		BindAddr: addr,
 		Tags:     tags,
 	}
-	h := &handler{}
-	if len(members) == 0 {
-		h.joins = make(chan map[string]string, 3)
-		h.leaves = make(chan string, 3)
-	} else {
+	if fn != nil {
+		fn(&c)
+	}
+	h := &handler{
+		joins:  make(chan map[string]string, 10),
+		leaves: make(chan string, 10),
+	}
+	if len(members) != 0 {
 		c.StartJoinAddrs = []string{
 			members[0].BindAddr,
 		}
@@ -0,0 +1,34 @@
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// tokenTag is the tag holding the member's token, an HMAC of its name and
+// RPC address signed with the cluster's secret. Members without a valid
+// token aren't joined to the cluster.
+const tokenTag = "token"
+
+func sign(secret []byte, name, rpcAddr string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(rpcAddr))
+	return mac.Sum(nil)
+}
+
+func signToken(secret []byte, name, rpcAddr string) string {
+	return base64.StdEncoding.EncodeToString(sign(secret, name, rpcAddr))
+}
+
+func validToken(secret []byte, member serf.Member) bool {
+	token, err := base64.StdEncoding.DecodeString(member.Tags[tokenTag])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(token, sign(secret, member.Name, member.Tags["rpc_addr"]))
+}
@@ -0,0 +1,22 @@
+package loadbalance
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/balancer"
+)
+
+func (p *Picker) SetConfig(config *Config) {
+	p.setConfig(config)
+}
+
+// ParseConfig parses the balancer's config like gRPC does with the service
+// config's loadBalancingConfig.
+func ParseConfig(js string) (*Config, error) {
+	parser := balancer.Get(Name).(balancer.ConfigParser)
+	config, err := parser.ParseConfig(json.RawMessage(js))
+	if err != nil {
+		return nil, err
+	}
+	return config.(*Config), nil
+}
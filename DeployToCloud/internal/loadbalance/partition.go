@@ -0,0 +1,52 @@
+package loadbalance
+
+import (
+	"context"
+	"hash/fnv"
+)
+
+type partitionKey struct{}
+
+// WithPartition has the Picker send the call to the partition's leader when
+// the call goes to a leader, calls without a partition go to partition 0's.
+func WithPartition(ctx context.Context, partition uint32) context.Context {
+	return context.WithValue(ctx, partitionKey{}, partition)
+}
+
+func partitionFromContext(ctx context.Context) uint32 {
+	if ctx == nil {
+		return 0
+	}
+	partition, _ := ctx.Value(partitionKey{}).(uint32)
+	return partition
+}
+
+// PartitionFor returns the partition of the given number of partitions the
+// key's records belong to.
+func PartitionFor(key []byte, partitions uint32) uint32 {
+	if partitions == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return h.Sum32() % partitions
+}
+
+// LeaderPartitions are the partitions a server leads, the Resolver sets them
+// as the "leader_partitions" address attribute.
+type LeaderPartitions []uint32
+
+// Equal implements the comparison attributes need for values that aren't
+// comparable.
+func (l LeaderPartitions) Equal(o interface{}) bool {
+	other, ok := o.(LeaderPartitions)
+	if !ok || len(l) != len(other) {
+		return false
+	}
+	for i := range l {
+		if l[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,6 @@
 package loadbalance
 
 import (
-	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -14,15 +13,50 @@ var _ base.PickerBuilder = (*Picker)(nil)
 type Picker struct {
 	mu        sync.RWMutex
 	leader    balancer.SubConn
+	leaders   map[uint32]balancer.SubConn
 	followers []balancer.SubConn
+	all       []balancer.SubConn
+	config    *Config
 	current   uint64
+	// outstanding counts the calls in flight on each sub conn when the
+	// least loaded follower is picked.
+	outstanding map[balancer.SubConn]*int64
 }
 
 func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	var followers []balancer.SubConn
+	var maxLag uint64
+	if p.config != nil {
+		maxLag = p.config.MaxLag
+	}
+	var highest uint64
+	for _, scInfo := range buildInfo.ReadySCs {
+		applied, _ := scInfo.
+			Address.
+			Attributes.
+			Value("applied_index").(uint64)
+		if applied > highest {
+			highest = applied
+		}
+	}
+	var followers, remote, all []balancer.SubConn
+	p.leaders = make(map[uint32]balancer.SubConn)
+	outstanding := make(map[balancer.SubConn]*int64)
 	for sc, scInfo := range buildInfo.ReadySCs {
+		all = append(all, sc)
+		if n, ok := p.outstanding[sc]; ok {
+			outstanding[sc] = n
+		} else {
+			outstanding[sc] = new(int64)
+		}
+		partitions, _ := scInfo.
+			Address.
+			Attributes.
+			Value("leader_partitions").(LeaderPartitions)
+		for _, partition := range partitions {
+			p.leaders[partition] = sc
+		}
 		isLeader := scInfo.
 			Address.
 			Attributes.
@@ -31,40 +65,124 @@ func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 			p.leader = sc
 			continue
 		}
+		// skip the followers too far behind, a follower's unknown index
+		// doesn't make it lag
+		applied, _ := scInfo.
+			Address.
+			Attributes.
+			Value("applied_index").(uint64)
+		if maxLag != 0 && applied != 0 && highest-applied > maxLag {
+			continue
+		}
+		sameZone, ok := scInfo.
+			Address.
+			Attributes.
+			Value("same_zone").(bool)
+		if ok && !sameZone {
+			remote = append(remote, sc)
+			continue
+		}
 		followers = append(followers, sc)
 	}
+	// prefer the followers in the client's zone, the followers in other
+	// zones are only picked when none in the client's zone are ready
+	if len(followers) == 0 {
+		followers = remote
+	}
 	p.followers = followers
+	p.all = all
+	p.outstanding = outstanding
 	return p
 }
 
+// setConfig sets the balancer's config, the base balancer builds the
+// picker again right after.
+func (p *Picker) setConfig(config *Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config = config
+}
+
 var _ balancer.Picker = (*Picker)(nil)
 
 func (p *Picker) Pick(info balancer.PickInfo) (
 	balancer.PickResult, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
+	routes := DefaultRoutes
+	if p.config != nil && p.config.Routes != nil {
+		routes = p.config.Routes
+	}
 	var result balancer.PickResult
-	if strings.Contains(info.FullMethodName, "Produce") ||
-		len(p.followers) == 0 {
-		result.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Consume") {
-		result.SubConn = p.nextFollower()
+	switch routes.route(info.FullMethodName) {
+	case RouteLeader:
+		result.SubConn = p.leaderFor(info)
+	case RouteFollower:
+		if len(p.followers) == 0 {
+			result.SubConn = p.leaderFor(info)
+		} else {
+			result.SubConn = p.nextFollower()
+		}
+	default:
+		result.SubConn = p.next(p.all)
 	}
 	if result.SubConn == nil {
 		return result, balancer.ErrNoSubConnAvailable
 	}
+	if n, ok := p.outstanding[result.SubConn]; ok && p.leastLoaded() {
+		atomic.AddInt64(n, 1)
+		result.Done = func(balancer.DoneInfo) {
+			atomic.AddInt64(n, -1)
+		}
+	}
 	return result, nil
 }
 
+func (p *Picker) leastLoaded() bool {
+	return p.config != nil && p.config.LeastLoaded
+}
+
+// leaderFor returns the leader of the call's partition, calls without a
+// partition go to partition 0's leader.
+func (p *Picker) leaderFor(info balancer.PickInfo) balancer.SubConn {
+	partition := partitionFromContext(info.Ctx)
+	if sc, ok := p.leaders[partition]; ok {
+		return sc
+	}
+	if partition == 0 {
+		return p.leader
+	}
+	return nil
+}
+
+// nextFollower round robins over the followers, or picks the one with the
+// fewest outstanding calls, starting from the next follower in turn so
+// ties are spread out.
 func (p *Picker) nextFollower() balancer.SubConn {
+	if !p.leastLoaded() || len(p.followers) == 0 {
+		return p.next(p.followers)
+	}
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	var picked balancer.SubConn
+	var fewest int64
+	for i := range p.followers {
+		sc := p.followers[(cur+uint64(i))%uint64(len(p.followers))]
+		n := atomic.LoadInt64(p.outstanding[sc])
+		if picked == nil || n < fewest {
+			picked, fewest = sc, n
+		}
+	}
+	return picked
+}
+
+func (p *Picker) next(scs []balancer.SubConn) balancer.SubConn {
+	if len(scs) == 0 {
+		return nil
+	}
 	cur := atomic.AddUint64(&p.current, uint64(1))
-	len := uint64(len(p.followers))
-	idx := int(cur % len)
-	return p.followers[idx]
+	return scs[cur%uint64(len(scs))]
 }
 
 func init() {
-	balancer.Register(
-		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
-	)
+	balancer.Register(&builder{})
 }
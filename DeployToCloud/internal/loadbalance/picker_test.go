@@ -1,6 +1,7 @@
 package loadbalance_test
 
 import (
+	"context"
 	"testing"
 
 	"google.golang.org/grpc/attributes"
@@ -10,14 +11,15 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	api "github.com/igor-baiborodine/proglog/api/v1"
 	"github.com/igor-baiborodine/proglog/internal/loadbalance"
 )
 
 func TestPickerNoSubConnAvailable(t *testing.T) {
 	picker := &loadbalance.Picker{}
 	for _, method := range []string{
-		"/log.vX.Log/Produce",
-		"/log.vX.Log/Consume",
+		api.Log_Produce_FullMethodName,
+		api.Log_Consume_FullMethodName,
 	} {
 		info := balancer.PickInfo{
 			FullMethodName: method,
@@ -31,19 +33,26 @@ func TestPickerNoSubConnAvailable(t *testing.T) {
 func TestPickerProducesToLeader(t *testing.T) {
 	picker, subConns := setupTest()
 	info := balancer.PickInfo{
-		FullMethodName: "/log.vX.Log/Produce",
+		FullMethodName: api.Log_Produce_FullMethodName,
 	}
 	for i := 0; i < 5; i++ {
 		gotPick, err := picker.Pick(info)
 		require.NoError(t, err)
 		require.Equal(t, subConns[0], gotPick.SubConn)
 	}
+
+	// the committed offsets are read from the leader, the followers' may
+	// be stale
+	info.FullMethodName = api.Log_FetchOffset_FullMethodName
+	gotPick, err := picker.Pick(info)
+	require.NoError(t, err)
+	require.True(t, subConns[0] == gotPick.SubConn)
 }
 
 func TestPickerConsumesFromFollowers(t *testing.T) {
 	picker, subConns := setupTest()
 	info := balancer.PickInfo{
-		FullMethodName: "/log.vX.Log/Consume",
+		FullMethodName: api.Log_Consume_FullMethodName,
 	}
 	for i := 0; i < 5; i++ {
 		pick, err := picker.Pick(info)
@@ -52,22 +61,219 @@ func TestPickerConsumesFromFollowers(t *testing.T) {
 	}
 }
 
+func TestPickerProducesToPartitionLeader(t *testing.T) {
+	var attrs []*attributes.Attributes
+	for i := 0; i < 3; i++ {
+		// each sub conn leads the partition with its index
+		attrs = append(attrs, attributes.New("is_leader", i == 0).WithValue(
+			"leader_partitions",
+			loadbalance.LeaderPartitions{uint32(i)},
+		))
+	}
+	picker, subConns := setupPicker(nil, attrs...)
+
+	for partition, want := range map[uint32]*subConn{
+		0: subConns[0],
+		1: subConns[1],
+		2: subConns[2],
+	} {
+		info := balancer.PickInfo{
+			FullMethodName: api.Log_Produce_FullMethodName,
+			Ctx: loadbalance.WithPartition(
+				context.Background(),
+				partition,
+			),
+		}
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, want, pick.SubConn)
+
+		// the partition's leader has its authoritative offsets
+		info.FullMethodName = api.Log_GetOffsets_FullMethodName
+		pick, err = picker.Pick(info)
+		require.NoError(t, err)
+		require.True(t, want == pick.SubConn)
+	}
+
+	info := balancer.PickInfo{
+		FullMethodName: api.Log_Produce_FullMethodName,
+		Ctx:            loadbalance.WithPartition(context.Background(), 3),
+	}
+	_, err := picker.Pick(info)
+	require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+}
+
+func TestPickerPrefersSameZoneFollowers(t *testing.T) {
+	build := func(sameZone ...bool) (*loadbalance.Picker, []*subConn) {
+		var attrs []*attributes.Attributes
+		for i, same := range sameZone {
+			attrs = append(attrs, attributes.New("is_leader", i == 0).
+				WithValue("same_zone", same))
+		}
+		return setupPicker(nil, attrs...)
+	}
+	info := balancer.PickInfo{FullMethodName: api.Log_Consume_FullMethodName}
+
+	picker, subConns := build(false, false, true, false)
+	for i := 0; i < 5; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[2], pick.SubConn)
+	}
+
+	// without a ready follower in the client's zone, the other zones'
+	// followers are picked
+	picker, subConns = build(true, false, false)
+	picks := make(map[balancer.SubConn]bool)
+	for i := 0; i < 4; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		picks[pick.SubConn] = true
+	}
+	require.Equal(t, map[balancer.SubConn]bool{
+		subConns[1]: true,
+		subConns[2]: true,
+	}, picks)
+}
+
+func TestPickerRoutes(t *testing.T) {
+	picker, subConns := setupTest()
+
+	// methods without a route go to any ready server
+	picks := make(map[balancer.SubConn]bool)
+	for i := 0; i < 3; i++ {
+		pick, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: api.Log_GetServers_FullMethodName,
+		})
+		require.NoError(t, err)
+		picks[pick.SubConn] = true
+	}
+	require.Equal(t, 3, len(picks))
+
+	config, err := loadbalance.ParseConfig(
+		`{"routes":{"/log.v1.Log/Consume":"leader"}}`,
+	)
+	require.NoError(t, err)
+	routes := config.Routes
+	require.Equal(t, loadbalance.RouteLeader, routes[api.Log_Consume_FullMethodName])
+	require.Equal(t, loadbalance.RouteLeader, routes[api.Log_Produce_FullMethodName])
+	picker.SetConfig(config)
+	for i := 0; i < 3; i++ {
+		pick, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: api.Log_Consume_FullMethodName,
+		})
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], pick.SubConn)
+	}
+
+	_, err = loadbalance.ParseConfig(`{"routes":{"/log.v1.Log/Consume":"nearest"}}`)
+	require.Error(t, err)
+}
+
+func TestPickerSkipsLaggingFollowers(t *testing.T) {
+	var attrs []*attributes.Attributes
+	// the leader, a follower caught up, a lagging follower and a follower
+	// whose index is unknown
+	for i, applied := range []uint64{100, 95, 10, 0} {
+		a := attributes.New("is_leader", i == 0)
+		if applied != 0 {
+			a = a.WithValue("applied_index", applied)
+		}
+		attrs = append(attrs, a)
+	}
+	picker, subConns := setupPicker(&loadbalance.Config{MaxLag: 10}, attrs...)
+
+	info := balancer.PickInfo{FullMethodName: api.Log_Consume_FullMethodName}
+	picks := make(map[balancer.SubConn]bool)
+	for i := 0; i < 4; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		picks[pick.SubConn] = true
+	}
+	require.Equal(t, map[balancer.SubConn]bool{
+		subConns[1]: true,
+		subConns[3]: true,
+	}, picks)
+}
+
+func TestPickerPicksLeastLoadedFollower(t *testing.T) {
+	picker, _ := setupTest()
+	config, err := loadbalance.ParseConfig(`{"leastLoaded":true}`)
+	require.NoError(t, err)
+	picker.SetConfig(config)
+	info := balancer.PickInfo{FullMethodName: api.Log_Consume_FullMethodName}
+
+	// the first call stays outstanding, so the next calls go to the other
+	// follower
+	first, err := picker.Pick(info)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.True(t, first.SubConn != pick.SubConn)
+		pick.Done(balancer.DoneInfo{})
+	}
+
+	first.Done(balancer.DoneInfo{})
+	picks := make(map[balancer.SubConn]bool)
+	for i := 0; i < 4; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		picks[pick.SubConn] = true
+		pick.Done(balancer.DoneInfo{})
+	}
+	require.Equal(t, 2, len(picks))
+}
+
+func TestServiceConfig(t *testing.T) {
+	require.JSONEq(t,
+		`{"loadBalancingConfig":[{"proglog":{"routes":{"/log.v1.Log/Consume":"any"}}}]}`,
+		loadbalance.ServiceConfig(loadbalance.Config{
+			Routes: loadbalance.Routes{
+				api.Log_Consume_FullMethodName: loadbalance.RouteAny,
+			},
+		}),
+	)
+}
+
+func TestPartitionFor(t *testing.T) {
+	partition := loadbalance.PartitionFor([]byte("key"), 3)
+	require.Less(t, partition, uint32(3))
+	require.Equal(t, partition, loadbalance.PartitionFor([]byte("key"), 3))
+	require.Equal(t, uint32(0), loadbalance.PartitionFor([]byte("key"), 0))
+}
+
 func setupTest() (*loadbalance.Picker, []*subConn) {
+	// 0th sub conn is the leader
+	return setupPicker(
+		nil,
+		attributes.New("is_leader", true),
+		attributes.New("is_leader", false),
+		attributes.New("is_leader", false),
+	)
+}
+
+// setupPicker builds a picker with the config over a ready sub conn for
+// each of the addresses' attributes.
+func setupPicker(
+	config *loadbalance.Config,
+	attrs ...*attributes.Attributes,
+) (*loadbalance.Picker, []*subConn) {
 	var subConns []*subConn
 	buildInfo := base.PickerBuildInfo{
 		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
 	}
-	for i := 0; i < 3; i++ {
+	for _, a := range attrs {
 		sc := &subConn{}
-		addr := resolver.Address{
-			Attributes: attributes.New("is_leader", i == 0),
-		}
-		// 0th sub conn is the leader
+		addr := resolver.Address{Attributes: a}
 		sc.UpdateAddresses([]resolver.Address{addr})
 		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
 		subConns = append(subConns, sc)
 	}
 	picker := &loadbalance.Picker{}
+	if config != nil {
+		picker.SetConfig(config)
+	}
 	picker.Build(buildInfo)
 	return picker, subConns
 }
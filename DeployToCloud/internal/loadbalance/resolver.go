@@ -3,50 +3,116 @@ package loadbalance
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 
 	api "github.com/igor-baiborodine/proglog/api/v1"
 )
 
+const (
+	// defaultRefreshInterval is how often the servers are resolved again
+	// when the target has no refresh query parameter.
+	defaultRefreshInterval = 30 * time.Second
+	// minBackoff is how long the resolver first waits to retry after
+	// failing to resolve, it doubles up to the refresh interval.
+	minBackoff = 100 * time.Millisecond
+	// resolveTimeout bounds each seed's GetServers call.
+	resolveTimeout = 5 * time.Second
+)
+
+// Resolver resolves the servers from the target's seeds, e.g.
+// proglog:///host1:8400,host2:8400?zone=us-east-1a&refresh=10s, and hands
+// the balancer the config the target's query parameters set. It asks
+// the current seed and fails over to the next seed when the current one
+// fails. The servers are resolved again every refresh interval and on
+// every cluster change the seed's WatchCluster stream reports.
 type Resolver struct {
-	mu            sync.Mutex
-	clientConn    resolver.ClientConn
+	mu         sync.Mutex
+	clientConn resolver.ClientConn
+	// zone is the client's zone, set with the target's zone query
+	// parameter.
+	zone          string
+	seeds         []string
+	seed          int
+	dialOpts      []grpc.DialOption
+	refresh       time.Duration
 	resolverConn  *grpc.ClientConn
 	serviceConfig *serviceconfig.ParseResult
 	logger        *zap.Logger
+
+	changes chan struct{}
+	// ctx lives as long as the client conn, closing the conn cancels the
+	// resolver's in-flight calls.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   sync.WaitGroup
 }
 
 var _ resolver.Builder = (*Resolver)(nil)
 
-func (r *Resolver) Build(
+// Build builds a new resolver for every client conn, each one resolving in
+// its own goroutines.
+func (*Resolver) Build(
 	target resolver.Target,
 	cc resolver.ClientConn,
 	opts resolver.BuildOptions,
 ) (resolver.Resolver, error) {
-	r.logger = zap.L().Named("resolver")
-	r.clientConn = cc
-	var dialOpts []grpc.DialOption
+	r := &Resolver{
+		logger:     zap.L().Named("resolver"),
+		clientConn: cc,
+	}
+	query := target.URL.Query()
+	r.zone = query.Get("zone")
+	r.refresh = defaultRefreshInterval
+	if refresh := query.Get("refresh"); refresh != "" {
+		d, err := time.ParseDuration(refresh)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid refresh interval: %q", refresh)
+		}
+		r.refresh = d
+	}
+	for _, seed := range strings.Split(target.Endpoint(), ",") {
+		if seed != "" {
+			r.seeds = append(r.seeds, seed)
+		}
+	}
+	if len(r.seeds) == 0 {
+		return nil, fmt.Errorf("no seeds in target: %q", target.URL.String())
+	}
 	if opts.DialCreds != nil {
-		dialOpts = append(
-			dialOpts,
+		r.dialOpts = append(
+			r.dialOpts,
 			grpc.WithTransportCredentials(opts.DialCreds),
 		)
 	}
-	r.serviceConfig = r.clientConn.ParseServiceConfig(
-		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
-	)
-	var err error
-	r.resolverConn, err = grpc.Dial(target.Endpoint(), dialOpts...)
+	config, err := configFromQuery(query)
 	if err != nil {
 		return nil, err
 	}
+	r.serviceConfig = r.clientConn.ParseServiceConfig(ServiceConfig(config))
+	if r.serviceConfig != nil && r.serviceConfig.Err != nil {
+		return nil, r.serviceConfig.Err
+	}
+	r.resolverConn, err = grpc.Dial(r.seeds[0], r.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
 	r.ResolveNow(resolver.ResolveNowOptions{})
+
+	r.changes = make(chan struct{}, 1)
+	r.done.Add(2)
+	go r.refreshEvery(r.ctx)
+	go r.watch(r.ctx)
 	return r, nil
 }
 
@@ -62,28 +128,140 @@ func init() {
 
 var _ resolver.Resolver = (*Resolver)(nil)
 
+// ResolveNow resolves the servers within the resolver's context, so closing
+// the client conn cancels a resolution that's still waiting on a seed.
 func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	if err := r.resolve(); err != nil {
+		r.logger.Error(
+			"failed to resolve server",
+			zap.Error(err),
+		)
+		r.clientConn.ReportError(err)
+	}
+}
+
+// resolve gets the servers from the current seed, failing over to the
+// other seeds in turn, and sets them on the client conn.
+func (r *Resolver) resolve() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	var err error
+	for range r.seeds {
+		var res *api.GetServersResponse
+		res, err = r.getServers()
+		if err == nil {
+			r.leaderIndexes(res.Servers)
+			r.updateState(res.Servers)
+			return nil
+		}
+		r.logger.Warn(
+			"failed to resolve from seed",
+			zap.String("seed", r.seeds[r.seed]),
+			zap.Error(err),
+		)
+		if ferr := r.failover(); ferr != nil {
+			return ferr
+		}
+	}
+	return err
+}
+
+func (r *Resolver) getServers() (*api.GetServersResponse, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, resolveTimeout)
+	defer cancel()
 	client := api.NewLogClient(r.resolverConn)
-	// get cluster and then set on cc attributes
-	ctx := context.Background()
-	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	return client.GetServers(ctx, &api.GetServersRequest{})
+}
+
+// leaderIndexes sets the followers' applied indexes from the leader when
+// the seed is a follower, which only knows its own index. A seed that
+// reports an index but not the leader's isn't the leader. The servers keep
+// the seed's indexes when the leader can't be asked.
+func (r *Resolver) leaderIndexes(servers []*api.Server) {
+	var leader *api.Server
+	var known bool
+	for _, server := range servers {
+		if server.IsLeader {
+			leader = server
+		}
+		known = known || server.AppliedIndex != 0
+	}
+	if leader == nil || leader.AppliedIndex != 0 || !known {
+		return
+	}
+	conn, err := grpc.Dial(leader.RpcAddr, r.dialOpts...)
 	if err != nil {
-		r.logger.Error(
-			"failed to resolve server",
+		r.logger.Warn("failed to dial leader", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(r.ctx, resolveTimeout)
+	defer cancel()
+	res, err := api.NewLogClient(conn).GetServers(
+		ctx,
+		&api.GetServersRequest{},
+	)
+	if err != nil {
+		r.logger.Warn(
+			"failed to get applied indexes from leader",
+			zap.String("leader", leader.RpcAddr),
 			zap.Error(err),
 		)
 		return
 	}
-	var addrs []resolver.Address
+	indexes := make(map[string]uint64)
 	for _, server := range res.Servers {
+		indexes[server.Id] = server.AppliedIndex
+	}
+	for _, server := range servers {
+		server.AppliedIndex = indexes[server.Id]
+	}
+}
+
+// failover dials the next seed. The caller must hold r.mu.
+func (r *Resolver) failover() error {
+	if len(r.seeds) == 1 {
+		return nil
+	}
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+	r.seed = (r.seed + 1) % len(r.seeds)
+	conn, err := grpc.Dial(r.seeds[r.seed], r.dialOpts...)
+	if err != nil {
+		return err
+	}
+	r.resolverConn = conn
+	return nil
+}
+
+// updateState sets the servers on the client conn. The caller must hold
+// r.mu.
+func (r *Resolver) updateState(servers []*api.Server) {
+	var addrs []resolver.Address
+	for _, server := range servers {
+		attrs := attributes.New(
+			"is_leader",
+			server.IsLeader,
+		)
+		if server.AppliedIndex != 0 {
+			attrs = attrs.WithValue("applied_index", server.AppliedIndex)
+		}
+		if server.Zone != "" {
+			attrs = attrs.WithValue("zone", server.Zone)
+		}
+		if r.zone != "" {
+			attrs = attrs.WithValue("same_zone", server.Zone == r.zone)
+		}
+		if len(server.LeaderPartitions) != 0 {
+			attrs = attrs.WithValue(
+				"leader_partitions",
+				LeaderPartitions(server.LeaderPartitions),
+			)
+		}
 		addrs = append(addrs, resolver.Address{
-			Addr: server.RpcAddr,
-			Attributes: attributes.New(
-				"is_leader",
-				server.IsLeader,
-			),
+			Addr:       server.RpcAddr,
+			Attributes: attrs,
 		})
 	}
 	r.clientConn.UpdateState(resolver.State{
@@ -92,7 +270,86 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 	})
 }
 
+// refreshEvery resolves the servers every refresh interval and when the
+// cluster changes. After a failure it retries with a backoff, doubling up
+// to the refresh interval.
+func (r *Resolver) refreshEvery(ctx context.Context) {
+	defer r.done.Done()
+	backoff := minBackoff
+	timer := time.NewTimer(r.refresh)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-r.changes:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		next := r.refresh
+		if err := r.resolve(); err != nil {
+			r.logger.Error("failed to refresh servers", zap.Error(err))
+			r.clientConn.ReportError(err)
+			next = backoff
+			backoff *= 2
+			if backoff > r.refresh {
+				backoff = r.refresh
+			}
+		} else {
+			backoff = minBackoff
+		}
+		timer.Reset(next)
+	}
+}
+
+// watch streams the cluster's changes from the current seed to resolve
+// the servers as soon as they change. Servers that can't watch the cluster
+// leave the resolver to the refresh interval.
+func (r *Resolver) watch(ctx context.Context) {
+	defer r.done.Done()
+	backoff := minBackoff
+	for {
+		r.mu.Lock()
+		client := api.NewLogClient(r.resolverConn)
+		r.mu.Unlock()
+		stream, err := client.WatchCluster(ctx, &api.WatchClusterRequest{})
+		if err == nil {
+			for {
+				if _, err = stream.Recv(); err != nil {
+					break
+				}
+				backoff = minBackoff
+				select {
+				case r.changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.Unimplemented {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > r.refresh {
+			backoff = r.refresh
+		}
+	}
+}
+
 func (r *Resolver) Close() {
+	r.cancel()
+	r.done.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if err := r.resolverConn.Close(); err != nil {
 		r.logger.Error(
 			"failed to close conn",
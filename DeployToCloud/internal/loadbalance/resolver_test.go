@@ -1,11 +1,17 @@
 package loadbalance_test
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/credentials"
@@ -52,8 +58,7 @@ func TestResolver(t *testing.T) {
 	opts := resolver.BuildOptions{
 		DialCreds: clientCreds,
 	}
-	r := &loadbalance.Resolver{}
-	_, err = r.Build(
+	r, err := (&loadbalance.Resolver{}).Build(
 		resolver.Target{
 			URL: url.URL{Path: l.Addr().String()},
 		},
@@ -61,21 +66,45 @@ func TestResolver(t *testing.T) {
 		opts,
 	)
 	require.NoError(t, err)
+	defer r.Close()
 
 	wantState := resolver.State{
 		Addresses: []resolver.Address{{
 			Addr:       "localhost:9001",
 			Attributes: attributes.New("is_leader", true),
 		}, {
-			Addr:       "localhost:9002",
-			Attributes: attributes.New("is_leader", false),
+			Addr: "localhost:9002",
+			Attributes: attributes.New("is_leader", false).
+				WithValue("zone", "zone-a"),
 		}},
 	}
-	require.Equal(t, wantState, conn.state)
+	require.Equal(t, wantState, conn.State())
 
-	conn.state.Addresses = nil
+	conn.reset()
 	r.ResolveNow(resolver.ResolveNowOptions{})
-	require.Equal(t, wantState, conn.state)
+	require.Equal(t, wantState, conn.State())
+
+	// a client in a zone gets told which servers share its zone
+	zoneConn := &clientConn{}
+	zr, err := (&loadbalance.Resolver{}).Build(
+		resolver.Target{
+			URL: url.URL{Path: l.Addr().String(), RawQuery: "zone=zone-a"},
+		},
+		zoneConn,
+		opts,
+	)
+	require.NoError(t, err)
+	defer zr.Close()
+	require.Equal(t, []resolver.Address{{
+		Addr: "localhost:9001",
+		Attributes: attributes.New("is_leader", true).
+			WithValue("same_zone", false),
+	}, {
+		Addr: "localhost:9002",
+		Attributes: attributes.New("is_leader", false).
+			WithValue("zone", "zone-a").
+			WithValue("same_zone", true),
+	}}, zoneConn.State().Addresses)
 }
 
 type getServers struct{}
@@ -88,20 +117,47 @@ func (s *getServers) GetServers() ([]*api.Server, error) {
 	}, {
 		Id:      "follower",
 		RpcAddr: "localhost:9002",
+		Zone:    "zone-a",
 	}}, nil
 }
 
 type clientConn struct {
 	resolver.ClientConn
-	state resolver.State
+	mu     sync.Mutex
+	state  resolver.State
+	errors int
 }
 
 func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.state = state
 	return nil
 }
 
-func (c *clientConn) ReportError(err error) {}
+func (c *clientConn) State() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *clientConn) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = resolver.State{}
+}
+
+func (c *clientConn) ReportError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors++
+}
+
+func (c *clientConn) Errors() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.errors
+}
 
 func (c *clientConn) NewAddress(addrs []resolver.Address) {}
 
@@ -112,3 +168,353 @@ func (c *clientConn) ParseServiceConfig(
 ) *serviceconfig.ParseResult {
 	return nil
 }
+
+func TestResolverFailsOverSeeds(t *testing.T) {
+	addr := setupResolverServer(t, &server.Config{GetServerer: &getServers{}})
+	down := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+
+	conn := &clientConn{}
+	r, err := (&loadbalance.Resolver{}).Build(
+		resolver.Target{URL: url.URL{Path: down + "," + addr}},
+		conn,
+		resolverBuildOptions(t),
+	)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, 2, len(conn.State().Addresses))
+}
+
+func TestResolverReportsErrors(t *testing.T) {
+	down := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+
+	conn := &clientConn{}
+	r, err := (&loadbalance.Resolver{}).Build(
+		resolver.Target{URL: url.URL{Path: down, RawQuery: "refresh=50ms"}},
+		conn,
+		resolverBuildOptions(t),
+	)
+	require.NoError(t, err)
+	defer r.Close()
+	// the failed build and the retries after it
+	require.Eventually(t, func() bool {
+		return conn.Errors() >= 3
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestResolverAsksLeaderForAppliedIndexes(t *testing.T) {
+	leaderAddr := setupResolverServer(t, &server.Config{
+		GetServerer: serversFunc(func() ([]*api.Server, error) {
+			return []*api.Server{
+				{Id: "leader", IsLeader: true, AppliedIndex: 10},
+				{Id: "follower", AppliedIndex: 7},
+			}, nil
+		}),
+	})
+	// the follower only knows its own index
+	followerAddr := setupResolverServer(t, &server.Config{
+		GetServerer: serversFunc(func() ([]*api.Server, error) {
+			return []*api.Server{
+				{Id: "leader", RpcAddr: leaderAddr, IsLeader: true},
+				{Id: "follower", RpcAddr: "localhost:9002", AppliedIndex: 9},
+			}, nil
+		}),
+	})
+
+	conn := &clientConn{}
+	r, err := (&loadbalance.Resolver{}).Build(
+		resolver.Target{URL: url.URL{Path: followerAddr}},
+		conn,
+		resolverBuildOptions(t),
+	)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, []resolver.Address{{
+		Addr: leaderAddr,
+		Attributes: attributes.New("is_leader", true).
+			WithValue("applied_index", uint64(10)),
+	}, {
+		Addr: "localhost:9002",
+		Attributes: attributes.New("is_leader", false).
+			WithValue("applied_index", uint64(7)),
+	}}, conn.State().Addresses)
+}
+
+func TestResolverRefreshes(t *testing.T) {
+	servers := &changingServers{}
+	servers.set(1)
+	watcher := &clusterWatcher{events: make(chan *api.ClusterEvent, 1)}
+	watchedAddr := setupResolverServer(t, &server.Config{
+		GetServerer:    servers,
+		ClusterWatcher: watcher,
+	})
+	polledAddr := setupResolverServer(t, &server.Config{GetServerer: servers})
+
+	// the watched resolver only refreshes on the cluster's changes
+	watched := &clientConn{}
+	r, err := (&loadbalance.Resolver{}).Build(
+		resolver.Target{URL: url.URL{Path: watchedAddr, RawQuery: "refresh=1h"}},
+		watched,
+		resolverBuildOptions(t),
+	)
+	require.NoError(t, err)
+	defer r.Close()
+	// the server without a cluster watch is polled
+	polled := &clientConn{}
+	r, err = (&loadbalance.Resolver{}).Build(
+		resolver.Target{URL: url.URL{Path: polledAddr, RawQuery: "refresh=100ms"}},
+		polled,
+		resolverBuildOptions(t),
+	)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, 1, len(watched.State().Addresses))
+	require.Equal(t, 1, len(polled.State().Addresses))
+
+	servers.set(2)
+	require.Eventually(t, func() bool {
+		return len(polled.State().Addresses) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	watcher.events <- &api.ClusterEvent{Type: api.ClusterEvent_SERVER_JOIN}
+	require.Eventually(t, func() bool {
+		return len(watched.State().Addresses) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestResolverTwoClusters(t *testing.T) {
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	// every conn resolves and picks from its own cluster's servers
+	var clients []api.LogClient
+	for _, id := range []string{"east", "west"} {
+		servers := &clusterServers{id: id}
+		addr := setupResolverServer(t, &server.Config{GetServerer: servers})
+		servers.setAddr(addr)
+		conn, err := grpc.Dial(
+			fmt.Sprintf("%s:///%s", loadbalance.Name, addr),
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		clients = append(clients, api.NewLogClient(conn))
+	}
+	for i := 0; i < 10; i++ {
+		for j, id := range []string{"east", "west"} {
+			res, err := clients[j].GetServers(
+				context.Background(),
+				&api.GetServersRequest{},
+			)
+			require.NoError(t, err)
+			require.Equal(t, id, res.Servers[0].Id)
+		}
+	}
+}
+
+func TestResolverRoutesFromTarget(t *testing.T) {
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	creds := grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+
+	cluster := &leaderAndFollower{}
+	leader := setupResolverServer(t, &server.Config{
+		GetServerer: serversFunc(func() ([]*api.Server, error) {
+			return cluster.servers(), nil
+		}),
+	})
+	follower := setupResolverServer(t, &server.Config{
+		GetServerer: serversFunc(func() ([]*api.Server, error) {
+			cluster.followerCalls.Add(1)
+			return cluster.servers(), nil
+		}),
+	})
+	cluster.set(leader, follower)
+
+	// GetServers goes to any server by default, the target routes it to
+	// the follower
+	balancer := loadbalance.Config{Routes: loadbalance.Routes{
+		api.Log_GetServers_FullMethodName: loadbalance.RouteFollower,
+	}}
+	conn, err := grpc.Dial(
+		fmt.Sprintf(
+			"%s:///%s?%s",
+			loadbalance.Name,
+			leader,
+			balancer.Query().Encode(),
+		),
+		creds,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	client := api.NewLogClient(conn)
+	getServers := func() {
+		_, err := client.GetServers(
+			context.Background(),
+			&api.GetServersRequest{},
+		)
+		require.NoError(t, err)
+	}
+
+	// the picker sends the follower's calls to the leader until the
+	// follower's ready
+	require.Eventually(t, func() bool {
+		getServers()
+		return cluster.followerCalls.Load() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	before := cluster.followerCalls.Load()
+	for i := 0; i < 10; i++ {
+		getServers()
+	}
+	require.Equal(t, before+10, cluster.followerCalls.Load())
+
+	// the balancer rejects the target's invalid routes
+	_, err = grpc.Dial(
+		fmt.Sprintf(
+			"%s:///%s?route=%s:nowhere",
+			loadbalance.Name,
+			leader,
+			api.Log_GetServers_FullMethodName,
+		),
+		creds,
+	)
+	require.Error(t, err)
+}
+
+func setupResolverServer(t *testing.T, c *server.Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(c, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String()
+}
+
+func resolverBuildOptions(t *testing.T) resolver.BuildOptions {
+	t.Helper()
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	return resolver.BuildOptions{DialCreds: credentials.NewTLS(tlsConfig)}
+}
+
+// serversFunc returns the servers the func returns.
+type serversFunc func() ([]*api.Server, error)
+
+func (f serversFunc) GetServers() ([]*api.Server, error) {
+	return f()
+}
+
+// changingServers returns the number of servers it's set to.
+type changingServers struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (s *changingServers) set(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n = n
+}
+
+func (s *changingServers) GetServers() ([]*api.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var servers []*api.Server
+	for i := 0; i < s.n; i++ {
+		servers = append(servers, &api.Server{
+			Id:       fmt.Sprintf("%d", i),
+			RpcAddr:  fmt.Sprintf("localhost:%d", 9001+i),
+			IsLeader: i == 0,
+		})
+	}
+	return servers, nil
+}
+
+type clusterWatcher struct {
+	events chan *api.ClusterEvent
+}
+
+func (w *clusterWatcher) WatchCluster() (
+	<-chan *api.ClusterEvent,
+	func(),
+	error,
+) {
+	return w.events, func() {}, nil
+}
+
+// clusterServers is a cluster of one server that leads it.
+type clusterServers struct {
+	mu   sync.Mutex
+	id   string
+	addr string
+}
+
+func (s *clusterServers) setAddr(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addr = addr
+}
+
+func (s *clusterServers) GetServers() ([]*api.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []*api.Server{{
+		Id:       s.id,
+		RpcAddr:  s.addr,
+		IsLeader: true,
+	}}, nil
+}
+
+// leaderAndFollower is a cluster of a leader and a follower, it counts the
+// follower's GetServers calls.
+type leaderAndFollower struct {
+	mu            sync.Mutex
+	leader        string
+	follower      string
+	followerCalls atomic.Int64
+}
+
+func (c *leaderAndFollower) set(leader, follower string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader, c.follower = leader, follower
+}
+
+func (c *leaderAndFollower) servers() []*api.Server {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []*api.Server{{
+		Id:       "leader",
+		RpcAddr:  c.leader,
+		IsLeader: true,
+	}, {
+		Id:      "follower",
+		RpcAddr: c.follower,
+	}}
+}
@@ -0,0 +1,198 @@
+package loadbalance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+)
+
+// Route is where the picker sends a method's calls.
+type Route string
+
+const (
+	// RouteLeader sends the calls to the leader of the call's partition.
+	RouteLeader Route = "leader"
+	// RouteFollower sends the calls to the followers, or to the leader when
+	// there are none.
+	RouteFollower Route = "follower"
+	// RouteAny sends the calls to any ready server.
+	RouteAny Route = "any"
+)
+
+// Routes maps full method names, like /log.v1.Log/Produce, to their routes.
+// Methods that aren't in the routes are sent to any ready server.
+type Routes map[string]Route
+
+// DefaultRoutes send the writes to the leader and the reads to the
+// followers, except the reads that must be current, like the committed
+// offsets.
+var DefaultRoutes = Routes{
+	api.Log_Produce_FullMethodName:              RouteLeader,
+	api.Log_ProduceStream_FullMethodName:        RouteLeader,
+	api.Log_CommitOffset_FullMethodName:         RouteLeader,
+	api.Log_Consume_FullMethodName:              RouteFollower,
+	api.Log_ConsumeStream_FullMethodName:        RouteFollower,
+	api.Log_FetchOffset_FullMethodName:          RouteLeader,
+	api.Log_GetOffsets_FullMethodName:           RouteLeader,
+	api.Admin_TransferLeadership_FullMethodName: RouteLeader,
+	api.Admin_RemoveServer_FullMethodName:       RouteLeader,
+	api.Admin_AddVoter_FullMethodName:           RouteLeader,
+	api.Admin_AddNonvoter_FullMethodName:        RouteLeader,
+}
+
+func (r Routes) route(method string) Route {
+	if route, ok := r[method]; ok {
+		return route
+	}
+	return RouteAny
+}
+
+// Config is the balancer's config in the service config, e.g.
+// {"loadBalancingConfig":[{"proglog":{"routes":{"/log.v1.Log/Consume":"any"}}}]}.
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+	// Routes override the default routes.
+	Routes Routes `json:"routes,omitempty"`
+	// MaxLag is how many entries a follower may trail the most up to date
+	// server by and still be picked, 0 picks followers however far behind
+	// they are. The lag is measured in partition 0's log, as the leader
+	// last saw it when the servers were resolved.
+	MaxLag uint64 `json:"maxLag,omitempty"`
+	// LeastLoaded picks the follower with the fewest outstanding calls
+	// instead of round robin.
+	LeastLoaded bool `json:"leastLoaded,omitempty"`
+}
+
+// ServiceConfig returns the service config JSON with the balancer's config.
+// The resolver's service config holds the config from the target's query
+// parameters, see Config.Query.
+func ServiceConfig(config Config) string {
+	b, _ := json.Marshal(map[string]interface{}{
+		"loadBalancingConfig": []map[string]Config{{
+			Name: config,
+		}},
+	})
+	return string(b)
+}
+
+// Query returns the target query parameters that set the config, e.g.
+// route=/log.v1.Log/Consume:leader&maxLag=100&leastLoaded=true. Each route
+// param sets one method's route, the other methods keep their default
+// routes.
+func (c Config) Query() url.Values {
+	query := make(url.Values)
+	for method, route := range c.Routes {
+		query.Add("route", fmt.Sprintf("%s:%s", method, route))
+	}
+	if c.MaxLag != 0 {
+		query.Set("maxLag", strconv.FormatUint(c.MaxLag, 10))
+	}
+	if c.LeastLoaded {
+		query.Set("leastLoaded", "true")
+	}
+	return query
+}
+
+// configFromQuery parses the config the target's query parameters set.
+func configFromQuery(query url.Values) (Config, error) {
+	var config Config
+	for _, param := range query["route"] {
+		i := strings.LastIndex(param, ":")
+		if i <= 0 {
+			return config, fmt.Errorf("invalid route: %q", param)
+		}
+		if config.Routes == nil {
+			config.Routes = make(Routes)
+		}
+		config.Routes[param[:i]] = Route(param[i+1:])
+	}
+	if maxLag := query.Get("maxLag"); maxLag != "" {
+		n, err := strconv.ParseUint(maxLag, 10, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid max lag: %q", maxLag)
+		}
+		config.MaxLag = n
+	}
+	if leastLoaded := query.Get("leastLoaded"); leastLoaded != "" {
+		b, err := strconv.ParseBool(leastLoaded)
+		if err != nil {
+			return config, fmt.Errorf("invalid least loaded: %q", leastLoaded)
+		}
+		config.LeastLoaded = b
+	}
+	return config, nil
+}
+
+var _ balancer.ConfigParser = (*builder)(nil)
+
+// builder builds a base balancer with its own picker for every client
+// conn, and hands the config parsed from the service config to the picker.
+type builder struct{}
+
+func (b *builder) Name() string {
+	return Name
+}
+
+func (b *builder) ParseConfig(
+	js json.RawMessage,
+) (serviceconfig.LoadBalancingConfig, error) {
+	var config Config
+	if err := json.Unmarshal(js, &config); err != nil {
+		return nil, err
+	}
+	routes := make(Routes)
+	for method, route := range DefaultRoutes {
+		routes[method] = route
+	}
+	for method, route := range config.Routes {
+		switch route {
+		case RouteLeader, RouteFollower, RouteAny:
+		default:
+			return nil, fmt.Errorf("invalid route for %s: %q", method, route)
+		}
+		routes[method] = route
+	}
+	config.Routes = routes
+	return &config, nil
+}
+
+func (b *builder) Build(
+	cc balancer.ClientConn,
+	opts balancer.BuildOptions,
+) balancer.Balancer {
+	picker := &Picker{}
+	return &routingBalancer{
+		Balancer: base.NewBalancerBuilder(
+			Name,
+			picker,
+			base.Config{},
+		).Build(cc, opts),
+		picker: picker,
+	}
+}
+
+type routingBalancer struct {
+	balancer.Balancer
+	picker *Picker
+}
+
+func (b *routingBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if config, ok := s.BalancerConfig.(*Config); ok {
+		b.picker.setConfig(config)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+func (b *routingBalancer) ExitIdle() {
+	if ei, ok := b.Balancer.(balancer.ExitIdler); ok {
+		ei.ExitIdle()
+	}
+}
@@ -0,0 +1,257 @@
+package log
+
+import (
+	"fmt"
+	"strconv"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+)
+
+type RequestType uint8
+
+const (
+	AppendRequestType       RequestType = 0
+	TruncateRequestType     RequestType = 1
+	DeleteTopicRequestType  RequestType = 2
+	SetConfigRequestType    RequestType = 3
+	CommitOffsetRequestType RequestType = 4
+	PinNonvoterRequestType  RequestType = 5
+)
+
+const (
+	MaxStoreBytesConfig = "segment.max_store_bytes"
+	MaxIndexBytesConfig = "segment.max_index_bytes"
+)
+
+// maxProducers is how many idempotent producers the FSM keeps the last
+// append of. Every node must keep the same producers, so it isn't a config,
+// only the tests change it.
+var maxProducers = 10000
+
+// command is a replicated request the FSM knows how to apply. Every node
+// applies the same commands in the same order, so apply must only depend
+// on the request and the FSM's state.
+type command struct {
+	newRequest func() proto.Message
+	apply      func(f *fsm, req proto.Message) interface{}
+}
+
+var commands = map[RequestType]command{}
+
+func registerCommand(
+	reqType RequestType,
+	newRequest func() proto.Message,
+	apply func(f *fsm, req proto.Message) interface{},
+) {
+	if _, ok := commands[reqType]; ok {
+		panic(fmt.Sprintf("command already registered: %d", reqType))
+	}
+	commands[reqType] = command{newRequest: newRequest, apply: apply}
+}
+
+func init() {
+	registerCommand(
+		AppendRequestType,
+		func() proto.Message { return &api.ProduceRequest{} },
+		func(f *fsm, req proto.Message) interface{} {
+			return f.applyAppend(req.(*api.ProduceRequest))
+		},
+	)
+	registerCommand(
+		TruncateRequestType,
+		func() proto.Message { return &api.TruncateRequest{} },
+		func(f *fsm, req proto.Message) interface{} {
+			return f.applyTruncate(req.(*api.TruncateRequest))
+		},
+	)
+	registerCommand(
+		DeleteTopicRequestType,
+		func() proto.Message { return &api.DeleteTopicRequest{} },
+		func(f *fsm, req proto.Message) interface{} {
+			return f.applyDeleteTopic(req.(*api.DeleteTopicRequest))
+		},
+	)
+	registerCommand(
+		SetConfigRequestType,
+		func() proto.Message { return &api.SetConfigRequest{} },
+		func(f *fsm, req proto.Message) interface{} {
+			return f.applySetConfig(req.(*api.SetConfigRequest))
+		},
+	)
+	registerCommand(
+		CommitOffsetRequestType,
+		func() proto.Message { return &api.CommitOffsetRequest{} },
+		func(f *fsm, req proto.Message) interface{} {
+			return f.applyCommitOffset(req.(*api.CommitOffsetRequest))
+		},
+	)
+	registerCommand(
+		PinNonvoterRequestType,
+		func() proto.Message { return &api.PinNonvoterRequest{} },
+		func(f *fsm, req proto.Message) interface{} {
+			return f.applyPinNonvoter(req.(*api.PinNonvoterRequest))
+		},
+	)
+}
+
+// applyAppend appends the record. An idempotent producer's record is only
+// appended when it has the producer's next sequence, appending the last
+// sequence again returns the record's original offset. Past maxProducers
+// the producer that appended least recently is forgotten, its next append
+// fails as out of order and the client starts over with a new ID.
+func (f *fsm) applyAppend(req *api.ProduceRequest) interface{} {
+	if req.ProducerId == "" {
+		offset, err := f.log.Append(req.Record)
+		if err != nil {
+			return err
+		}
+		return &api.ProduceResponse{Offset: offset}
+	}
+	// a producer without appends has sequence 0, so its first sequence is 1
+	last := f.producers[req.ProducerId]
+	switch {
+	case req.Sequence == last.GetSequence()+1:
+	case req.Sequence != 0 && req.Sequence == last.GetSequence():
+		return &api.ProduceResponse{Offset: last.Offset}
+	case req.Sequence != 0 && req.Sequence < last.GetSequence():
+		return api.ErrDuplicateSequence{
+			ProducerID: req.ProducerId,
+			Sequence:   req.Sequence,
+		}
+	default:
+		return api.ErrOutOfOrderSequence{
+			ProducerID: req.ProducerId,
+			Sequence:   req.Sequence,
+			Expected:   last.GetSequence() + 1,
+		}
+	}
+	offset, err := f.log.Append(req.Record)
+	if err != nil {
+		return err
+	}
+	f.producers[req.ProducerId] = &api.ProducerState{
+		Sequence: req.Sequence,
+		Offset:   offset,
+	}
+	if len(f.producers) > maxProducers {
+		f.evictProducer()
+	}
+	return &api.ProduceResponse{Offset: offset}
+}
+
+// evictProducer forgets the producer whose last append has the lowest
+// offset, the offsets tell the same order on every node.
+func (f *fsm) evictProducer() {
+	var oldest string
+	var lowest uint64
+	for id, producer := range f.producers {
+		if oldest == "" || producer.Offset < lowest {
+			oldest, lowest = id, producer.Offset
+		}
+	}
+	delete(f.producers, oldest)
+}
+
+// applyTruncate removes the segments whose records are all before the
+// requested offset. The active segment is always kept so the log can
+// still be appended to.
+func (f *fsm) applyTruncate(req *api.TruncateRequest) interface{} {
+	if req.Offset == 0 {
+		return nil
+	}
+	highest, err := f.log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	lowest := req.Offset - 1
+	if lowest >= highest {
+		if highest == 0 {
+			return nil
+		}
+		lowest = highest - 1
+	}
+	return f.log.Truncate(lowest)
+}
+
+// applyDeleteTopic removes every record from the log. The log is a single
+// unnamed topic, so only "" is accepted. The log restarts at its next offset
+// so offsets are never reused.
+func (f *fsm) applyDeleteTopic(req *api.DeleteTopicRequest) interface{} {
+	if req.Topic != "" {
+		return fmt.Errorf("unknown topic: %q", req.Topic)
+	}
+	return f.log.resetAt(f.log.nextOffset())
+}
+
+func (f *fsm) applySetConfig(req *api.SetConfigRequest) interface{} {
+	if err := f.setConfig(req.Key, req.Value); err != nil {
+		return err
+	}
+	f.config[req.Key] = req.Value
+	return nil
+}
+
+// setConfig applies the config to the log, new segments pick it up.
+func (f *fsm) setConfig(key, value string) error {
+	switch key {
+	case MaxStoreBytesConfig, MaxIndexBytesConfig:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("invalid %s: must be positive", key)
+		}
+		f.log.configure(func(c *Config) {
+			if key == MaxStoreBytesConfig {
+				c.Segment.MaxStoreBytes = n
+			} else {
+				c.Segment.MaxIndexBytes = n
+			}
+		})
+		return nil
+	}
+	return fmt.Errorf("unknown config: %q", key)
+}
+
+func (f *fsm) applyCommitOffset(req *api.CommitOffsetRequest) interface{} {
+	if req.Group == "" {
+		return fmt.Errorf("missing consumer group")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.offsets[req.Group] = req.Offset
+	return nil
+}
+
+func (f *fsm) fetchOffset(group string) (uint64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	offset, ok := f.offsets[group]
+	if !ok {
+		return 0, api.ErrNoCommittedOffset{Group: group}
+	}
+	return offset, nil
+}
+
+// applyPinNonvoter records whether the server stays a nonvoter. Every node
+// keeps the pins, so whichever server leads knows not to promote them.
+func (f *fsm) applyPinNonvoter(req *api.PinNonvoterRequest) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.Pinned {
+		f.nonvoters[req.Id] = struct{}{}
+	} else {
+		delete(f.nonvoters, req.Id)
+	}
+	return nil
+}
+
+func (f *fsm) pinned(id string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, ok := f.nonvoters[id]
+	return ok
+}
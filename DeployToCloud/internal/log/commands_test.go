@@ -0,0 +1,191 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+)
+
+func TestFSM(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, f *fsm,
+	){
+		"unknown request type fails":        testUnknownRequestType,
+		"truncate before offset":            testApplyTruncate,
+		"delete topic keeps offsets":        testApplyDeleteTopic,
+		"set config":                        testApplySetConfig,
+		"snapshot restores state and empty": testSnapshotRestoreState,
+		"commit and fetch offset":           testApplyCommitOffset,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "fsm-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			fn(t, newFSM(log))
+		})
+	}
+}
+
+func testUnknownRequestType(t *testing.T, f *fsm) {
+	res := f.Apply(&raft.Log{Data: []byte{255}})
+	require.Error(t, res.(error))
+
+	res = f.Apply(&raft.Log{})
+	require.Error(t, res.(error))
+}
+
+func testApplyTruncate(t *testing.T, f *fsm) {
+	appendRecords(t, f, 3)
+
+	res := f.Apply(newCommand(t, TruncateRequestType, &api.TruncateRequest{
+		Offset: 2,
+	}))
+	require.Nil(t, res)
+
+	_, err := f.log.Read(0)
+	require.Error(t, err)
+	lowest, err := f.log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+
+	// truncating past the end keeps the active segment
+	res = f.Apply(newCommand(t, TruncateRequestType, &api.TruncateRequest{
+		Offset: 10,
+	}))
+	require.Nil(t, res)
+	appendRecords(t, f, 1)
+}
+
+func testApplyDeleteTopic(t *testing.T, f *fsm) {
+	appendRecords(t, f, 2)
+
+	res := f.Apply(newCommand(t, DeleteTopicRequestType,
+		&api.DeleteTopicRequest{Topic: "unknown"}))
+	require.Error(t, res.(error))
+
+	res = f.Apply(newCommand(t, DeleteTopicRequestType,
+		&api.DeleteTopicRequest{}))
+	require.Nil(t, res)
+
+	_, err := f.log.Read(1)
+	require.Error(t, err)
+	offsets := appendRecords(t, f, 1)
+	require.Equal(t, uint64(2), offsets[0])
+}
+
+func testApplySetConfig(t *testing.T, f *fsm) {
+	res := f.Apply(newCommand(t, SetConfigRequestType, &api.SetConfigRequest{
+		Key:   MaxStoreBytesConfig,
+		Value: "1024",
+	}))
+	require.Nil(t, res)
+	require.Equal(t, uint64(1024), f.log.Config.Segment.MaxStoreBytes)
+	require.Equal(t, "1024", f.config[MaxStoreBytesConfig])
+
+	res = f.Apply(newCommand(t, SetConfigRequestType, &api.SetConfigRequest{
+		Key:   MaxIndexBytesConfig,
+		Value: "zero",
+	}))
+	require.Error(t, res.(error))
+
+	res = f.Apply(newCommand(t, SetConfigRequestType, &api.SetConfigRequest{
+		Key:   "unknown",
+		Value: "1",
+	}))
+	require.Error(t, res.(error))
+	require.NotContains(t, f.config, "unknown")
+}
+
+func testSnapshotRestoreState(t *testing.T, f *fsm) {
+	appendRecords(t, f, 2)
+	f.Apply(newCommand(t, SetConfigRequestType, &api.SetConfigRequest{
+		Key:   MaxStoreBytesConfig,
+		Value: "64",
+	}))
+	f.Apply(newCommand(t, DeleteTopicRequestType, &api.DeleteTopicRequest{}))
+	f.Apply(newCommand(t, CommitOffsetRequestType, &api.CommitOffsetRequest{
+		Group:  "group",
+		Offset: 2,
+	}))
+
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, snap.(*snapshot).persist(&buf))
+
+	dir, err := os.MkdirTemp("", "fsm-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	restored := newFSM(log)
+	appendRecords(t, restored, 3)
+
+	require.NoError(t, restored.Restore(io.NopCloser(&buf)))
+	require.Equal(t, "64", restored.config[MaxStoreBytesConfig])
+	require.Equal(t, uint64(64), restored.log.Config.Segment.MaxStoreBytes)
+	offset, err := restored.fetchOffset("group")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offset)
+	_, err = restored.log.Read(0)
+	require.Error(t, err)
+	offsets := appendRecords(t, restored, 1)
+	require.Equal(t, uint64(2), offsets[0])
+}
+
+func testApplyCommitOffset(t *testing.T, f *fsm) {
+	_, err := f.fetchOffset("group")
+	require.Equal(t, api.ErrNoCommittedOffset{Group: "group"}, err)
+
+	res := f.Apply(newCommand(t, CommitOffsetRequestType,
+		&api.CommitOffsetRequest{Group: "group", Offset: 3}))
+	require.Nil(t, res)
+	offset, err := f.fetchOffset("group")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+
+	res = f.Apply(newCommand(t, CommitOffsetRequestType,
+		&api.CommitOffsetRequest{Offset: 3}))
+	require.Error(t, res.(error))
+}
+
+func newFSM(log *Log) *fsm {
+	return &fsm{
+		log:     log,
+		config:  make(map[string]string),
+		offsets: make(map[string]uint64),
+	}
+}
+
+func appendRecords(t *testing.T, f *fsm, n int) []uint64 {
+	t.Helper()
+	var offsets []uint64
+	for i := 0; i < n; i++ {
+		res := f.Apply(newCommand(t, AppendRequestType, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		}))
+		require.IsType(t, &api.ProduceResponse{}, res)
+		offsets = append(offsets, res.(*api.ProduceResponse).Offset)
+	}
+	return offsets
+}
+
+func newCommand(t *testing.T, reqType RequestType, req proto.Message) *raft.Log {
+	t.Helper()
+	b, err := proto.Marshal(req)
+	require.NoError(t, err)
+	return &raft.Log{Data: append([]byte{byte(reqType)}, b...)}
+}
@@ -1,6 +1,8 @@
 package log
 
 import (
+	"time"
+
 	"github.com/hashicorp/raft"
 )
 
@@ -10,6 +12,22 @@ type Config struct {
 		BindAddr    string
 		StreamLayer *StreamLayer
 		Bootstrap   bool
+		// TransportMaxPool is how many connections to each peer the
+		// transport keeps open for reuse.
+		TransportMaxPool int
+		// TransportTimeout bounds the transport's reads and writes.
+		TransportTimeout time.Duration
+		// SnapshotRetain is how many snapshots are kept on disk.
+		SnapshotRetain int
+		// ApplyTimeout bounds applying an entry when the caller has no
+		// deadline of its own.
+		ApplyTimeout time.Duration
+		// PromotionLag is how many entries a joined nonvoter may trail the
+		// leader's log by and still be promoted to a voter.
+		PromotionLag uint64
+		// PromotionInterval is how often the leader checks whether the
+		// joined nonvoters have caught up.
+		PromotionInterval time.Duration
 	}
 
 	Segment struct {
@@ -17,4 +35,10 @@ type Config struct {
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+
+	Partition struct {
+		// BalanceInterval is how often a PartitionedLog checks that the
+		// partitions' leaders are spread across the servers.
+		BalanceInterval time.Duration
+	}
 }
@@ -2,18 +2,20 @@ package log
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
-	raftboltdb "github.com/hashicorp/raft-boltdb"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
 
 	api "github.com/igor-baiborodine/proglog/api/v1"
 )
@@ -22,6 +24,25 @@ type DistributedLog struct {
 	config Config
 	log    *Log
 	raft   *raft.Raft
+	fsm    *fsm
+
+	transport *progressTransport
+	closed    chan struct{}
+
+	mu           sync.Mutex
+	observations chan raft.Observation
+	observer     *raft.Observer
+	contacts     map[raft.ServerID]peerContact
+	// stored is the last configuration the FSM stored, the cluster events
+	// are built from it so publishing never waits on raft.
+	stored      raft.Configuration
+	watchers    map[uint64]chan *api.ClusterEvent
+	nextWatcher uint64
+}
+
+type peerContact struct {
+	lastContact time.Time
+	failing     bool
 }
 
 func NewDistributedLog(dataDir string, config Config) (
@@ -30,6 +51,7 @@ func NewDistributedLog(dataDir string, config Config) (
 ) {
 	l := &DistributedLog{
 		config: config,
+		closed: make(chan struct{}),
 	}
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
@@ -37,6 +59,11 @@ func NewDistributedLog(dataDir string, config Config) (
 	if err := l.setupRaft(dataDir); err != nil {
 		return nil, err
 	}
+	interval := time.Second
+	if l.config.Raft.PromotionInterval != 0 {
+		interval = l.config.Raft.PromotionInterval
+	}
+	go l.promoteEvery(interval)
 	return l, nil
 }
 
@@ -51,47 +78,64 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 }
 
 func (l *DistributedLog) setupRaft(dataDir string) error {
-	fsm := &fsm{log: l.log}
+	l.fsm = &fsm{
+		log:             l.log,
+		config:          make(map[string]string),
+		producers:       make(map[string]*api.ProducerState),
+		offsets:         make(map[string]uint64),
+		nonvoters:       make(map[string]struct{}),
+		onConfiguration: l.onConfiguration,
+	}
 
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return err
 	}
-	logConfig := l.config
-	logConfig.Segment.InitialOffset = 1
-	logStore, err := newLogStore(logDir, logConfig)
+	stableStore, err := openStableStore(filepath.Join(dataDir, "raft"))
 	if err != nil {
 		return err
 	}
 
-	stableStore, err := raftboltdb.NewBoltStore(
-		filepath.Join(dataDir, "raft", "stable"),
-	)
+	logStore, err := newLogStore(logDir, l.config, stableStore)
 	if err != nil {
 		return err
 	}
 
+	logger := newHCLogAdapter(zap.L(), "raft")
+
 	retain := 1
-	snapshotStore, err := raft.NewFileSnapshotStore(
+	if l.config.Raft.SnapshotRetain != 0 {
+		retain = l.config.Raft.SnapshotRetain
+	}
+	snapshotStore, err := raft.NewFileSnapshotStoreWithLogger(
 		filepath.Join(dataDir, "raft"),
 		retain,
-		os.Stderr,
+		logger,
 	)
 	if err != nil {
 		return err
 	}
 
 	maxPool := 5
+	if l.config.Raft.TransportMaxPool != 0 {
+		maxPool = l.config.Raft.TransportMaxPool
+	}
 	timeout := 10 * time.Second
-	transport := raft.NewNetworkTransport(
-		l.config.Raft.StreamLayer,
-		maxPool,
-		timeout,
-		os.Stderr,
-	)
+	if l.config.Raft.TransportTimeout != 0 {
+		timeout = l.config.Raft.TransportTimeout
+	}
+	l.transport = newProgressTransport(raft.NewNetworkTransportWithConfig(
+		&raft.NetworkTransportConfig{
+			Stream:  l.config.Raft.StreamLayer,
+			MaxPool: maxPool,
+			Timeout: timeout,
+			Logger:  logger,
+		},
+	))
 
 	config := raft.DefaultConfig()
 	config.LocalID = l.config.Raft.LocalID
+	config.Logger = logger
 	if l.config.Raft.HeartbeatTimeout != 0 {
 		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
 	}
@@ -104,18 +148,28 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if l.config.Raft.CommitTimeout != 0 {
 		config.CommitTimeout = l.config.Raft.CommitTimeout
 	}
+	if l.config.Raft.SnapshotInterval != 0 {
+		config.SnapshotInterval = l.config.Raft.SnapshotInterval
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+	if l.config.Raft.TrailingLogs != 0 {
+		config.TrailingLogs = l.config.Raft.TrailingLogs
+	}
 
 	l.raft, err = raft.NewRaft(
 		config,
-		fsm,
+		l.fsm,
 		logStore,
 		stableStore,
 		snapshotStore,
-		transport,
+		l.transport,
 	)
 	if err != nil {
 		return err
 	}
+	l.setupObserver()
 	if l.config.Raft.Bootstrap {
 		config := raft.Configuration{
 			Servers: []raft.Server{{
@@ -128,8 +182,169 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	return err
 }
 
+// setupObserver tracks leadership changes to notify cluster watchers and
+// the leader's failed and resumed heartbeats to its followers so RaftStats
+// can report the failing peers.
+func (l *DistributedLog) setupObserver() {
+	configuration := l.raft.GetConfiguration().Configuration()
+	l.mu.Lock()
+	l.contacts = make(map[raft.ServerID]peerContact)
+	l.watchers = make(map[uint64]chan *api.ClusterEvent)
+	l.stored = configuration
+	l.mu.Unlock()
+	l.observations = make(chan raft.Observation, 16)
+	l.observer = raft.NewObserver(
+		l.observations,
+		false,
+		func(o *raft.Observation) bool {
+			switch o.Data.(type) {
+			case raft.LeaderObservation,
+				raft.FailedHeartbeatObservation,
+				raft.ResumedHeartbeatObservation:
+				return true
+			}
+			return false
+		},
+	)
+	l.raft.RegisterObserver(l.observer)
+	go l.observe()
+}
+
+func (l *DistributedLog) observe() {
+	for o := range l.observations {
+		l.mu.Lock()
+		switch data := o.Data.(type) {
+		case raft.LeaderObservation:
+			l.publish(&api.ClusterEvent{
+				Type: api.ClusterEvent_LEADER_CHANGE,
+				Server: &api.Server{
+					Id:       string(data.LeaderID),
+					RpcAddr:  string(data.LeaderAddr),
+					IsLeader: data.LeaderID != "",
+				},
+			})
+		case raft.FailedHeartbeatObservation:
+			l.contacts[data.PeerID] = peerContact{
+				lastContact: data.LastContact,
+				failing:     true,
+			}
+		case raft.ResumedHeartbeatObservation:
+			l.contacts[data.PeerID] = peerContact{
+				lastContact: time.Now(),
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// onConfiguration is called by the FSM on every node once a configuration
+// change commits, so joins and leaves are seen by followers too.
+func (l *DistributedLog) onConfiguration(configuration raft.Configuration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	previous := addresses(l.stored)
+	servers := addresses(configuration)
+	l.stored = configuration.Clone()
+	for id, addr := range servers {
+		if _, ok := previous[id]; !ok {
+			l.publish(&api.ClusterEvent{
+				Type:   api.ClusterEvent_SERVER_JOIN,
+				Server: &api.Server{Id: string(id), RpcAddr: string(addr)},
+			})
+		}
+	}
+	for id, addr := range previous {
+		if _, ok := servers[id]; !ok {
+			l.publish(&api.ClusterEvent{
+				Type:   api.ClusterEvent_SERVER_LEAVE,
+				Server: &api.Server{Id: string(id), RpcAddr: string(addr)},
+			})
+		}
+	}
+}
+
+func addresses(
+	configuration raft.Configuration,
+) map[raft.ServerID]raft.ServerAddress {
+	servers := make(map[raft.ServerID]raft.ServerAddress)
+	for _, srv := range configuration.Servers {
+		servers[srv.ID] = srv.Address
+	}
+	return servers
+}
+
+// publish sends the event with the last stored configuration's servers to
+// every watcher. The caller must hold l.mu.
+func (l *DistributedLog) publish(event *api.ClusterEvent) {
+	if len(l.watchers) == 0 {
+		return
+	}
+	event.Servers = l.servers(l.stored)
+	for _, ch := range l.watchers {
+		send(ch, event)
+	}
+}
+
+// send never blocks on a slow watcher, instead it replaces the event the
+// watcher hasn't received yet. Every event carries the complete servers, so
+// the watcher still ends up with the current state of the cluster.
+func send(ch chan *api.ClusterEvent, event *api.ClusterEvent) {
+	for {
+		select {
+		case ch <- event:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// WatchCluster subscribes to leader and membership changes. The first
+// event has the current servers. Call the returned func to unsubscribe.
+func (l *DistributedLog) WatchCluster() (
+	<-chan *api.ClusterEvent,
+	func(),
+	error,
+) {
+	servers, err := l.GetServers()
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan *api.ClusterEvent, 1)
+	ch <- &api.ClusterEvent{
+		Type:    api.ClusterEvent_STATE,
+		Servers: servers,
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.nextWatcher
+	l.nextWatcher++
+	l.watchers[id] = ch
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.watchers[id]; ok {
+			delete(l.watchers, id)
+			close(ch)
+		}
+	}, nil
+}
+
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), record)
+}
+
+// AppendContext appends the record, waiting no longer than ctx's deadline
+// for it to be committed.
+func (l *DistributedLog) AppendContext(
+	ctx context.Context,
+	record *api.Record,
+) (uint64, error) {
 	res, err := l.apply(
+		ctx,
 		AppendRequestType,
 		&api.ProduceRequest{Record: record},
 	)
@@ -139,7 +354,96 @@ func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
 	return res.(*api.ProduceResponse).Offset, nil
 }
 
-func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
+// AppendProducer appends the record of an idempotent producer with its
+// next sequence. Appending the producer's last sequence again returns the
+// original offset instead of appending the record twice.
+func (l *DistributedLog) AppendProducer(
+	ctx context.Context,
+	producerID string,
+	sequence uint64,
+	record *api.Record,
+) (uint64, error) {
+	res, err := l.apply(
+		ctx,
+		AppendRequestType,
+		&api.ProduceRequest{
+			Record:     record,
+			ProducerId: producerID,
+			Sequence:   sequence,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// Truncate removes the records before offset on every node.
+func (l *DistributedLog) Truncate(offset uint64) error {
+	_, err := l.apply(
+		context.Background(),
+		TruncateRequestType,
+		&api.TruncateRequest{Offset: offset},
+	)
+	return err
+}
+
+// DeleteTopic removes every record on every node, the next record keeps the
+// offset it would have had. A DistributedLog is a single unnamed topic, so
+// topic must be "", there are no named topics to delete.
+func (l *DistributedLog) DeleteTopic(topic string) error {
+	_, err := l.apply(
+		context.Background(),
+		DeleteTopicRequestType,
+		&api.DeleteTopicRequest{Topic: topic},
+	)
+	return err
+}
+
+func (l *DistributedLog) SetConfig(key, value string) error {
+	_, err := l.apply(
+		context.Background(),
+		SetConfigRequestType,
+		&api.SetConfigRequest{Key: key, Value: value},
+	)
+	return err
+}
+
+// CommitOffset replicates the consumer group's offset so the group can
+// resume from it on any node.
+func (l *DistributedLog) CommitOffset(
+	ctx context.Context,
+	group string,
+	offset uint64,
+) error {
+	_, err := l.apply(
+		ctx,
+		CommitOffsetRequestType,
+		&api.CommitOffsetRequest{Group: group, Offset: offset},
+	)
+	return err
+}
+
+// FetchOffset returns the consumer group's committed offset. The leader
+// first checks it's still the leader, so it returns the latest commit it
+// applied. The followers read their own FSM, which may trail the leader's.
+func (l *DistributedLog) FetchOffset(group string) (uint64, error) {
+	if l.IsLeader() {
+		if err := l.raft.VerifyLeader().Error(); err != nil {
+			return 0, err
+		}
+	}
+	return l.fsm.fetchOffset(group)
+}
+
+// apply replicates the request and returns the FSM's response. It waits for
+// the request to be committed until ctx's deadline, or for ApplyTimeout if
+// ctx has none.
+func (l *DistributedLog) apply(
+	ctx context.Context,
+	reqType RequestType,
+	req proto.Message,
+) (
 	interface{},
 	error,
 ) {
@@ -157,9 +461,32 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 		return nil, err
 	}
 	timeout := 10 * time.Second
+	if l.config.Raft.ApplyTimeout != 0 {
+		timeout = l.config.Raft.ApplyTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	} else {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- future.Error()
+	}()
+	select {
+	case err = <-errc:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		// the entry may still be committed
+		return nil, ctx.Err()
 	}
 	res := future.Response()
 	if err, ok := res.(error); ok {
@@ -172,6 +499,22 @@ func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
 	return l.log.Read(offset)
 }
 
+// GetOffsets returns the range of the records this server applied, with its
+// Raft commit and applied indexes.
+func (l *DistributedLog) GetOffsets() (*api.GetOffsetsResponse, error) {
+	res, err := l.log.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	res.CommitIndex = l.raft.CommitIndex()
+	res.AppliedIndex = l.raft.AppliedIndex()
+	return res, nil
+}
+
+// Join adds the server as a nonvoter so it doesn't count toward the quorum
+// while it catches up, the leader promotes it to a voter once it's within
+// the configured lag. Joining a server that's already a nonvoter leaves it
+// for the leader to promote, unless an admin added it as a nonvoter.
 func (l *DistributedLog) Join(id, addr string) error {
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
@@ -186,22 +529,232 @@ func (l *DistributedLog) Join(id, addr string) error {
 				return nil
 			}
 			// remove the existing server
-			removeFuture := l.raft.RemoveServer(serverID, 0, 0)
-			if err := removeFuture.Error(); err != nil {
+			if err := l.RemoveServer(string(srv.ID)); err != nil {
 				return err
 			}
 		}
 	}
-	addFuture := l.raft.AddVoter(serverID, serverAddr, 0, 0)
-	if err := addFuture.Error(); err != nil {
+	l.transport.forget(serverID)
+	addFuture := l.raft.AddNonvoter(serverID, serverAddr, 0, 0)
+	return addFuture.Error()
+}
+
+// promoteEvery keeps checking whether the nonvoters have caught up. Any
+// server that becomes the leader promotes them, whichever server handled
+// their join.
+func (l *DistributedLog) promoteEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C:
+			_ = l.promote()
+		}
+	}
+}
+
+// promote adds the nonvoters whose match index is within the promotion lag
+// of the leader's last index as voters. The nonvoters an admin added stay
+// nonvoters.
+func (l *DistributedLog) promote() error {
+	if !l.IsLeader() {
+		return nil
+	}
+	servers, err := l.configuration()
+	if err != nil {
+		return err
+	}
+	lag := uint64(64)
+	if l.config.Raft.PromotionLag != 0 {
+		lag = l.config.Raft.PromotionLag
+	}
+	last := l.raft.LastIndex()
+	for _, srv := range servers {
+		if srv.Suffrage != raft.Nonvoter || l.fsm.pinned(string(srv.ID)) {
+			continue
+		}
+		match, ok := l.transport.matchIndex(srv.ID)
+		if !ok || match+lag < last {
+			continue
+		}
+		future := l.raft.AddVoter(srv.ID, srv.Address, 0, 0)
+		if err = future.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *DistributedLog) configuration() ([]raft.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	return future.Configuration().Servers, nil
+}
+
+// syncServers adds and removes servers so the log's servers match the
+// given servers.
+func (l *DistributedLog) syncServers(servers []raft.Server) error {
+	current, err := l.configuration()
+	if err != nil {
 		return err
 	}
+	want := make(map[raft.ServerID]bool)
+	for _, srv := range servers {
+		want[srv.ID] = true
+		if err = l.Join(string(srv.ID), string(srv.Address)); err != nil {
+			return err
+		}
+	}
+	for _, srv := range current {
+		if !want[srv.ID] {
+			if err = l.RemoveServer(string(srv.ID)); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 func (l *DistributedLog) Leave(id string) error {
+	return l.RemoveServer(id)
+}
+
+// RemoveServer removes the server and clears its nonvoter pin, so it's
+// promoted if it joins again.
+func (l *DistributedLog) RemoveServer(id string) error {
 	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
-	return removeFuture.Error()
+	if err := removeFuture.Error(); err != nil {
+		return err
+	}
+	return l.pinNonvoter(id, false)
+}
+
+// AddVoter adds the server as a voter, or promotes it when it's a nonvoter.
+func (l *DistributedLog) AddVoter(id, addr string) error {
+	if err := l.pinNonvoter(id, false); err != nil {
+		return err
+	}
+	addFuture := l.raft.AddVoter(
+		raft.ServerID(id),
+		raft.ServerAddress(addr),
+		0,
+		0,
+	)
+	return addFuture.Error()
+}
+
+// AddNonvoter adds the server as a nonvoter that's never promoted, it only
+// becomes a voter with AddVoter.
+func (l *DistributedLog) AddNonvoter(id, addr string) error {
+	if err := l.pinNonvoter(id, true); err != nil {
+		return err
+	}
+	addFuture := l.raft.AddNonvoter(
+		raft.ServerID(id),
+		raft.ServerAddress(addr),
+		0,
+		0,
+	)
+	return addFuture.Error()
+}
+
+// pinNonvoter replicates whether the server stays a nonvoter, the pin is
+// only replicated when it changes.
+func (l *DistributedLog) pinNonvoter(id string, pinned bool) error {
+	if l.fsm.pinned(id) == pinned {
+		return nil
+	}
+	_, err := l.apply(
+		context.Background(),
+		PinNonvoterRequestType,
+		&api.PinNonvoterRequest{Id: id, Pinned: pinned},
+	)
+	return err
+}
+
+// TransferLeadership hands leadership to the given server, or to the most
+// up-to-date follower when id is empty.
+func (l *DistributedLog) TransferLeadership(id, addr string) error {
+	var future raft.Future
+	if id == "" {
+		future = l.raft.LeadershipTransfer()
+	} else {
+		future = l.raft.LeadershipTransferToServer(
+			raft.ServerID(id),
+			raft.ServerAddress(addr),
+		)
+	}
+	return future.Error()
+}
+
+func (l *DistributedLog) Snapshot() (*api.SnapshotResponse, error) {
+	future := l.raft.Snapshot()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	meta, r, err := future.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.Close(); err != nil {
+		return nil, err
+	}
+	return &api.SnapshotResponse{
+		Id:    meta.ID,
+		Index: meta.Index,
+		Term:  meta.Term,
+	}, nil
+}
+
+func (l *DistributedLog) RaftStats() (*api.RaftStatsResponse, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	_, leaderID := l.raft.LeaderWithID()
+	res := &api.RaftStatsResponse{
+		State:        l.raft.State().String(),
+		Term:         l.raft.CurrentTerm(),
+		CommitIndex:  l.raft.CommitIndex(),
+		AppliedIndex: l.raft.AppliedIndex(),
+		LastLogIndex: l.raft.LastIndex(),
+		LeaderId:     string(leaderID),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, server := range future.Configuration().Servers {
+		peer := &api.PeerStats{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			Suffrage: server.Suffrage.String(),
+		}
+		switch {
+		case server.ID == l.config.Raft.LocalID:
+		case server.ID == leaderID:
+			// followers hear from the leader on every heartbeat
+			if last := l.raft.LastContact(); !last.IsZero() {
+				peer.LastContact = last.UnixNano()
+			}
+		default:
+			// the leader hears from its followers on every append and
+			// heartbeat, and raft tells it when their heartbeats fail
+			contact, ok := l.contacts[server.ID]
+			if ok {
+				peer.LastContact = contact.lastContact.UnixNano()
+				peer.Failing = contact.failing
+			}
+			last, ok := l.transport.lastContact(server.ID)
+			if ok && last.UnixNano() > peer.LastContact {
+				peer.LastContact = last.UnixNano()
+			}
+		}
+		res.Peers = append(res.Peers, peer)
+	}
+	return res, nil
 }
 
 func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
@@ -220,7 +773,71 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 	}
 }
 
+func (l *DistributedLog) IsLeader() bool {
+	return l.raft.State() == raft.Leader
+}
+
+// HasPeers reports whether there are other voters that can take over
+// leadership from this server.
+func (l *DistributedLog) HasPeers() (bool, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return false, err
+	}
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID != l.config.Raft.LocalID && srv.Suffrage == raft.Voter {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// WaitForRemoval blocks until the leader has removed this server from the
+// Raft configuration, or until this server is the only one left and there's
+// no one to remove it.
+func (l *DistributedLog) WaitForRemoval(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	var remaining []raft.ServerID
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf(
+				"timed out waiting for removal, servers: %v",
+				remaining,
+			)
+		case <-ticker.C:
+			future := l.raft.GetConfiguration()
+			if err := future.Error(); err != nil {
+				return err
+			}
+			servers := future.Configuration().Servers
+			removed := true
+			remaining = remaining[:0]
+			for _, srv := range servers {
+				if srv.ID == l.config.Raft.LocalID {
+					removed = false
+				}
+				remaining = append(remaining, srv.ID)
+			}
+			if removed || len(servers) == 1 {
+				return nil
+			}
+		}
+	}
+}
+
 func (l *DistributedLog) Close() error {
+	close(l.closed)
+	l.raft.DeregisterObserver(l.observer)
+	close(l.observations)
+	l.mu.Lock()
+	for id, ch := range l.watchers {
+		delete(l.watchers, id)
+		close(ch)
+	}
+	l.mu.Unlock()
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
@@ -233,130 +850,324 @@ func (l *DistributedLog) GetServers() ([]*api.Server, error) {
 	if err := future.Error(); err != nil {
 		return nil, err
 	}
+	return l.servers(future.Configuration()), nil
+}
+
+// servers describes the configuration's servers. It doesn't wait on raft's
+// main loop, so it's safe to call from the FSM and the observer.
+func (l *DistributedLog) servers(
+	configuration raft.Configuration,
+) []*api.Server {
+	isLeader := l.IsLeader()
 	var servers []*api.Server
-	for _, server := range future.Configuration().Servers {
-		servers = append(servers, &api.Server{
+	for _, server := range configuration.Servers {
+		s := &api.Server{
 			Id:       string(server.ID),
 			RpcAddr:  string(server.Address),
 			IsLeader: l.raft.Leader() == server.Address,
-		})
+			Suffrage: server.Suffrage.String(),
+		}
+		switch {
+		case server.ID == l.config.Raft.LocalID:
+			s.AppliedIndex = l.raft.AppliedIndex()
+		case isLeader:
+			// the followers apply the entries the leader replicated to
+			// them once they learn the entries committed
+			s.AppliedIndex, _ = l.transport.matchIndex(server.ID)
+		}
+		servers = append(servers, s)
 	}
-	return servers, nil
+	return servers
 }
 
 var _ raft.FSM = (*fsm)(nil)
 
 type fsm struct {
 	log *Log
-}
+	// config holds the settings replicated with SetConfigRequestType.
+	config map[string]string
+	// producers holds the last append of each idempotent producer, it's
+	// only used by raft's FSM goroutine.
+	producers map[string]*api.ProducerState
 
-type RequestType uint8
+	// offsets holds the consumer groups' committed offsets and nonvoters
+	// the servers an admin added as nonvoters, they're read outside of
+	// raft's FSM goroutine.
+	mu        sync.RWMutex
+	offsets   map[string]uint64
+	nonvoters map[string]struct{}
 
-const (
-	AppendRequestType RequestType = 0
-)
+	onConfiguration func(raft.Configuration)
+}
 
 func (f *fsm) Apply(record *raft.Log) interface{} {
 	buf := record.Data
+	if len(buf) == 0 {
+		return fmt.Errorf("empty request")
+	}
 	reqType := RequestType(buf[0])
-	switch reqType {
-	case AppendRequestType:
-		return f.applyAppend(buf[1:])
+	cmd, ok := commands[reqType]
+	if !ok {
+		return fmt.Errorf("unknown request type: %d", reqType)
 	}
-	return nil
-}
-
-func (f *fsm) applyAppend(b []byte) interface{} {
-	var req api.ProduceRequest
-	err := proto.Unmarshal(b, &req)
-	if err != nil {
+	req := cmd.newRequest()
+	if err := proto.Unmarshal(buf[1:], req); err != nil {
 		return err
 	}
-	offset, err := f.log.Append(req.Record)
-	if err != nil {
-		return err
+	return cmd.apply(f, req)
+}
+
+var _ raft.ConfigurationStore = (*fsm)(nil)
+
+func (f *fsm) StoreConfiguration(_ uint64, configuration raft.Configuration) {
+	if f.onConfiguration != nil {
+		f.onConfiguration(configuration)
 	}
-	return &api.ProduceResponse{Offset: offset}
 }
 
+// snapshotMagic starts snapshots that have the FSM's state before the
+// records. It can't be mistaken for the length of the first record in
+// snapshots that only have records.
+const snapshotMagic = ^uint64(0)
+
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	state := &api.FSMState{
+		Config:     make(map[string]string),
+		NextOffset: f.log.nextOffset(),
+		Offsets:    make(map[string]uint64),
+		Producers:  make(map[string]*api.ProducerState),
+	}
+	for k, v := range f.config {
+		state.Config[k] = v
+	}
+	for id, producer := range f.producers {
+		state.Producers[id] = &api.ProducerState{
+			Sequence: producer.Sequence,
+			Offset:   producer.Offset,
+		}
+	}
+	f.mu.RLock()
+	for group, offset := range f.offsets {
+		state.Offsets[group] = offset
+	}
+	for id := range f.nonvoters {
+		state.Nonvoters = append(state.Nonvoters, id)
+	}
+	f.mu.RUnlock()
 	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	return &snapshot{state: state, reader: r}, nil
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
 type snapshot struct {
+	state  *api.FSMState
 	reader io.Reader
 }
 
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	if _, err := io.Copy(sink, s.reader); err != nil {
+	if err := s.persist(sink); err != nil {
 		_ = sink.Cancel()
 		return err
 	}
 	return sink.Close()
 }
 
+func (s *snapshot) persist(w io.Writer) error {
+	state, err := proto.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 2*lenWidth)
+	enc.PutUint64(header, snapshotMagic)
+	enc.PutUint64(header[lenWidth:], uint64(len(state)))
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	if _, err = w.Write(state); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, s.reader)
+	return err
+}
+
 func (s *snapshot) Release() {}
 
 func (f *fsm) Restore(r io.ReadCloser) error {
 	b := make([]byte, lenWidth)
 	var buf bytes.Buffer
-	for i := 0; ; i++ {
+	var state *api.FSMState
+	first := true
+	for {
 		_, err := io.ReadFull(r, b)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
-		size := int64(enc.Uint64(b))
-		if _, err = io.CopyN(&buf, r, size); err != nil {
+		size := enc.Uint64(b)
+		if size == snapshotMagic {
+			if state, err = f.restoreState(r); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err = io.CopyN(&buf, r, int64(size)); err != nil {
 			return err
 		}
 		record := &api.Record{}
 		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
 			return err
 		}
-		if i == 0 {
-			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
+		if first {
+			if err := f.log.resetAt(record.Offset); err != nil {
 				return err
 			}
+			first = false
 		}
 		if _, err = f.log.Append(record); err != nil {
 			return err
 		}
 		buf.Reset()
 	}
+	if first && state != nil {
+		// the snapshot was taken of an empty log
+		return f.log.resetAt(state.NextOffset)
+	}
 	return nil
 }
 
+func (f *fsm) restoreState(r io.Reader) (*api.FSMState, error) {
+	b := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	p := make([]byte, enc.Uint64(b))
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	state := &api.FSMState{}
+	if err := proto.Unmarshal(p, state); err != nil {
+		return nil, err
+	}
+	f.config = make(map[string]string)
+	for k, v := range state.Config {
+		if err := f.setConfig(k, v); err != nil {
+			return nil, err
+		}
+		f.config[k] = v
+	}
+	f.producers = make(map[string]*api.ProducerState)
+	for id, producer := range state.Producers {
+		f.producers[id] = producer
+	}
+	f.mu.Lock()
+	f.offsets = make(map[string]uint64)
+	for group, offset := range state.Offsets {
+		f.offsets[group] = offset
+	}
+	f.nonvoters = make(map[string]struct{})
+	for _, id := range state.Nonvoters {
+		f.nonvoters[id] = struct{}{}
+	}
+	f.mu.Unlock()
+	return state, nil
+}
+
 var _ raft.LogStore = (*logStore)(nil)
 
+// logStore stores raft's log in a Log whose offsets are raft's indexes.
+// Raft's log is contiguous except after a snapshot is installed, then the
+// entries before the gap are covered by the snapshot and are dropped.
+//
+// The Log only removes whole segments, so first tracks the lowest index
+// raft hasn't deleted and hides the entries before it. first is kept in the
+// stable store, so the hidden entries stay hidden after a restart.
 type logStore struct {
 	*Log
+	stable raft.StableStore
+	mu     sync.RWMutex
+	first  uint64
 }
 
-func newLogStore(dir string, c Config) (*logStore, error) {
+// firstIndexKey is the stable store's key for the log store's first index.
+var firstIndexKey = []byte("LogStoreFirstIndex")
+
+func newLogStore(
+	dir string,
+	c Config,
+	stable raft.StableStore,
+) (*logStore, error) {
 	log, err := NewLog(dir, c)
 	if err != nil {
 		return nil, err
 	}
-	return &logStore{log}, nil
+	first, err := log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	// like raft, tell a missing key by its message, so any stable store
+	// works
+	stored, err := stable.GetUint64(firstIndexKey)
+	switch {
+	case err != nil && err.Error() != errKeyNotFound.Error():
+		return nil, err
+	case err == nil && stored > first:
+		first = stored
+	}
+	return &logStore{Log: log, stable: stable, first: first}, nil
+}
+
+func (l *logStore) lowest() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.first
+}
+
+func (l *logStore) setLowest(first uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.stable.SetUint64(firstIndexKey, first); err != nil {
+		return err
+	}
+	l.first = first
+	return nil
+}
+
+func (l *logStore) empty() bool {
+	return l.lowest() >= l.nextOffset()
+}
+
+// reset removes every entry, the next entry stored must have index next.
+func (l *logStore) reset(next uint64) error {
+	if err := l.resetAt(next); err != nil {
+		return err
+	}
+	return l.setLowest(next)
 }
 
 func (l *logStore) FirstIndex() (uint64, error) {
-	return l.LowestOffset()
+	if l.empty() {
+		return 0, nil
+	}
+	return l.lowest(), nil
 }
 
 func (l *logStore) LastIndex() (uint64, error) {
-	off, err := l.HighestOffset()
-	return off, err
+	if l.empty() {
+		return 0, nil
+	}
+	return l.HighestOffset()
 }
 
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	if index < l.lowest() {
+		return raft.ErrLogNotFound
+	}
 	in, err := l.Read(index)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return raft.ErrLogNotFound
+	}
 	if err != nil {
 		return err
 	}
@@ -364,51 +1175,134 @@ func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	out.Index = in.Offset
 	out.Type = raft.LogType(in.Type)
 	out.Term = in.Term
+	out.Extensions = in.Extensions
+	out.AppendedAt = time.Time{}
+	if in.AppendedAt != 0 {
+		out.AppendedAt = time.Unix(0, in.AppendedAt)
+	}
 	return nil
 }
 
 func (l *logStore) StoreLog(record *raft.Log) error {
 	return l.StoreLogs([]*raft.Log{record})
 }
+
 func (l *logStore) StoreLogs(records []*raft.Log) error {
 	for _, record := range records {
-		if _, err := l.Append(&api.Record{
-			Value: record.Data,
-			Term:  record.Term,
-			Type:  uint32(record.Type),
-		}); err != nil {
+		if record.Index == 0 {
+			return fmt.Errorf("invalid log index: 0")
+		}
+		next := l.nextOffset()
+		switch {
+		case record.Index == next:
+		case l.empty() || record.Index > next:
+			if err := l.reset(record.Index); err != nil {
+				return err
+			}
+		default:
+			// overwrite the entry and everything after it
+			if err := l.truncateFrom(record.Index); err != nil {
+				return err
+			}
+		}
+		var appendedAt int64
+		if !record.AppendedAt.IsZero() {
+			appendedAt = record.AppendedAt.UnixNano()
+		}
+		off, err := l.Append(&api.Record{
+			Value:      record.Data,
+			Term:       record.Term,
+			Type:       uint32(record.Type),
+			Extensions: record.Extensions,
+			AppendedAt: appendedAt,
+		})
+		if err != nil {
 			return err
 		}
+		if off != record.Index {
+			return fmt.Errorf(
+				"stored log index %d at offset %d", record.Index, off,
+			)
+		}
 	}
 	return nil
 }
 
+// DeleteRange removes either a prefix of the log when raft compacts it
+// after a snapshot or a suffix when raft removes conflicting entries.
 func (l *logStore) DeleteRange(min, max uint64) error {
-	return l.Truncate(max)
+	first, err := l.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := l.LastIndex()
+	if err != nil {
+		return err
+	}
+	switch {
+	case first == 0 || max < first || min > last:
+		return nil
+	case min <= first && max >= last:
+		return l.reset(max + 1)
+	case min <= first:
+		// hide the entries before removing them, so a crash in between
+		// doesn't bring them back
+		if err = l.setLowest(max + 1); err != nil {
+			return err
+		}
+		return l.Truncate(max)
+	case max >= last:
+		return l.truncateFrom(min)
+	}
+	return fmt.Errorf("can't delete log range [%d, %d] inside [%d, %d]",
+		min, max, first, last)
 }
 
 var _ raft.StreamLayer = (*StreamLayer)(nil)
 
+// StreamLayer is a partition's raft transport. The partitions' stream
+// layers share a listener. Each raft connection starts with the RaftRPC
+// byte, so the agent's mux can tell it apart from gRPC, followed by the
+// TLS handshake and then the id of the partition it's for.
 type StreamLayer struct {
-	ln              net.Listener
-	serverTLSConfig *tls.Config
-	peerTLSConfig   *tls.Config
+	mux           *streamMux
+	partition     uint8
+	peerTLSConfig *tls.Config
 }
 
+// NewStreamLayer returns the stream layer for partition 0, use Partition
+// to get the other partitions' stream layers.
 func NewStreamLayer(
 	ln net.Listener,
 	serverTLSConfig,
 	peerTLSConfig *tls.Config,
 ) *StreamLayer {
-	return &StreamLayer{
-		ln:              ln,
-		serverTLSConfig: serverTLSConfig,
-		peerTLSConfig:   peerTLSConfig,
+	s := &StreamLayer{
+		mux:           newStreamMux(ln, serverTLSConfig),
+		peerTLSConfig: peerTLSConfig,
+	}
+	s.mux.register(s.partition)
+	return s
+}
+
+// Partition returns the stream layer for the given partition on the same
+// listener.
+func (s *StreamLayer) Partition(partition uint8) *StreamLayer {
+	p := &StreamLayer{
+		mux:           s.mux,
+		partition:     partition,
+		peerTLSConfig: s.peerTLSConfig,
 	}
+	p.mux.register(partition)
+	return p
 }
 
 const RaftRPC = 1
 
+// defaultHandshakeTimeout bounds how long an accepted connection has to
+// identify itself before it's dropped.
+const defaultHandshakeTimeout = 10 * time.Second
+
 func (s *StreamLayer) Dial(
 	addr raft.ServerAddress,
 	timeout time.Duration,
@@ -418,40 +1312,176 @@ func (s *StreamLayer) Dial(
 	if err != nil {
 		return nil, err
 	}
+	if timeout > 0 {
+		if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
 	// identify to mux this is a raft rpc
-	_, err = conn.Write([]byte{byte(RaftRPC)})
-	if err != nil {
+	if _, err = conn.Write([]byte{byte(RaftRPC)}); err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 	if s.peerTLSConfig != nil {
 		conn = tls.Client(conn, s.peerTLSConfig)
 	}
-	return conn, err
-}
-
-func (s *StreamLayer) Accept() (net.Conn, error) {
-	conn, err := s.ln.Accept()
-	if err != nil {
+	// and the partition it's for
+	if _, err = conn.Write([]byte{s.partition}); err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
-	b := make([]byte, 1)
-	_, err = conn.Read(b)
-	if err != nil {
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
-	if bytes.Compare([]byte{byte(RaftRPC)}, b) != 0 {
-		return nil, fmt.Errorf("not a raft rpc")
-	}
-	if s.serverTLSConfig != nil {
-		return tls.Server(conn, s.serverTLSConfig), nil
-	}
 	return conn, nil
 }
 
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	return s.mux.accept(s.partition)
+}
+
+// Close stops accepting the partition's connections, the listener is
+// closed with the last partition.
 func (s *StreamLayer) Close() error {
-	return s.ln.Close()
+	return s.mux.close(s.partition)
 }
 
 func (s *StreamLayer) Addr() net.Addr {
-	return s.ln.Addr()
+	return s.mux.ln.Addr()
+}
+
+// streamMux accepts the raft connections and hands them to the partition
+// they're for. Each connection's handshake runs in its own goroutine with a
+// deadline, so a slow or junk connection doesn't hold up the others and is
+// dropped instead of failing Accept.
+type streamMux struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	// handshakeTimeout is only read once serving starts on the first
+	// accept.
+	handshakeTimeout time.Duration
+	once             sync.Once
+
+	mu         sync.Mutex
+	partitions map[uint8]*streamPartition
+}
+
+type streamPartition struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newStreamMux(ln net.Listener, serverTLSConfig *tls.Config) *streamMux {
+	return &streamMux{
+		ln:               ln,
+		serverTLSConfig:  serverTLSConfig,
+		handshakeTimeout: defaultHandshakeTimeout,
+		partitions:       make(map[uint8]*streamPartition),
+	}
+}
+
+func (m *streamMux) register(partition uint8) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.partitions[partition]; ok {
+		return
+	}
+	m.partitions[partition] = &streamPartition{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (m *streamMux) get(partition uint8) *streamPartition {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.partitions[partition]
+}
+
+func (m *streamMux) accept(partition uint8) (net.Conn, error) {
+	m.once.Do(func() { go m.serve() })
+	p := m.get(partition)
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case <-p.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *streamMux) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			m.mu.Lock()
+			for _, p := range m.partitions {
+				select {
+				case <-p.closed:
+				default:
+					close(p.closed)
+				}
+			}
+			m.mu.Unlock()
+			return
+		}
+		go m.handshake(conn)
+	}
+}
+
+func (m *streamMux) handshake(conn net.Conn) {
+	if err := conn.SetDeadline(time.Now().Add(m.handshakeTimeout)); err != nil {
+		_ = conn.Close()
+		return
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil ||
+		!bytes.Equal(b, []byte{byte(RaftRPC)}) {
+		_ = conn.Close()
+		return
+	}
+	if m.serverTLSConfig != nil {
+		conn = tls.Server(conn, m.serverTLSConfig)
+	}
+	if _, err := io.ReadFull(conn, b); err != nil {
+		_ = conn.Close()
+		return
+	}
+	p := m.get(b[0])
+	if p == nil {
+		_ = conn.Close()
+		return
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return
+	}
+	select {
+	case p.conns <- conn:
+	case <-p.closed:
+		_ = conn.Close()
+	}
+}
+
+func (m *streamMux) close(partition uint8) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.partitions[partition]
+	if !ok {
+		return nil
+	}
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	for _, p := range m.partitions {
+		select {
+		case <-p.closed:
+		default:
+			return nil
+		}
+	}
+	return m.ln.Close()
 }
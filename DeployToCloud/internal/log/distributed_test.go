@@ -1,6 +1,7 @@
 package log_test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -118,3 +119,735 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset) // <label id="second_leave" />
 }
+
+func TestAdmin(t *testing.T) {
+	logs, addrs := setupCluster(t, 3)
+
+	_, err := logs[0].Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	snapshot, err := logs[0].Snapshot()
+	require.NoError(t, err)
+	require.NotEmpty(t, snapshot.Id)
+	require.NotZero(t, snapshot.Index)
+
+	stats, err := logs[0].RaftStats()
+	require.NoError(t, err)
+	require.Equal(t, raft.Leader.String(), stats.State)
+	require.Equal(t, "0", stats.LeaderId)
+	require.NotZero(t, stats.Term)
+	require.GreaterOrEqual(t, stats.CommitIndex, snapshot.Index)
+	require.Equal(t, 3, len(stats.Peers))
+	// the leader hears from its healthy followers
+	for _, peer := range stats.Peers {
+		if peer.Id != "0" {
+			require.NotZero(t, peer.LastContact)
+			require.False(t, peer.Failing)
+		}
+	}
+
+	err = logs[0].TransferLeadership("1", addrs[1])
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		stats, err := logs[1].RaftStats()
+		return err == nil && stats.State == raft.Leader.String()
+	}, 3*time.Second, 50*time.Millisecond)
+
+	stats, err = logs[0].RaftStats()
+	require.NoError(t, err)
+	require.Equal(t, "1", stats.LeaderId)
+	for _, peer := range stats.Peers {
+		if peer.Id == "1" {
+			require.NotZero(t, peer.LastContact)
+		}
+	}
+
+	require.NoError(t, logs[1].RemoveServer("2"))
+	require.NoError(t, logs[1].AddNonvoter("2", addrs[2]))
+	servers, err := logs[1].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	stats, err = logs[1].RaftStats()
+	require.NoError(t, err)
+	require.Equal(t, raft.Nonvoter.String(), stats.Peers[2].Suffrage)
+
+	require.NoError(t, logs[1].AddVoter("2", addrs[2]))
+	stats, err = logs[1].RaftStats()
+	require.NoError(t, err)
+	require.Equal(t, raft.Voter.String(), stats.Peers[2].Suffrage)
+}
+
+func setupCluster(t *testing.T, nodeCount int) (
+	logs []*log.DistributedLog,
+	addrs []string,
+) {
+	t.Helper()
+	for i := 0; i < nodeCount; i++ {
+		l, addr := setupNode(t, i, nil)
+		if i != 0 {
+			err := logs[0].Join(fmt.Sprintf("%d", i), addr)
+			require.NoError(t, err)
+			waitForSuffrage(t, logs[0], fmt.Sprintf("%d", i), raft.Voter)
+		}
+		logs = append(logs, l)
+		addrs = append(addrs, addr)
+	}
+	return logs, addrs
+}
+
+func waitForSuffrage(
+	t *testing.T,
+	l *log.DistributedLog,
+	id string,
+	suffrage raft.ServerSuffrage,
+) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		servers, err := l.GetServers()
+		if err != nil {
+			return false
+		}
+		for _, server := range servers {
+			if server.Id == id {
+				return server.Suffrage == suffrage.String()
+			}
+		}
+		return false
+	}, 3*time.Second, 20*time.Millisecond)
+}
+
+// setupNode starts a distributed log with the given id, node 0 bootstraps
+// the cluster and the others wait to be joined.
+func setupNode(t *testing.T, id int, fn func(*log.Config)) (
+	*log.DistributedLog,
+	string,
+) {
+	t.Helper()
+	dataDir, err := os.MkdirTemp("", "distributed-log-test")
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]))
+	require.NoError(t, err)
+
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", id))
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.PromotionInterval = 50 * time.Millisecond
+	config.Raft.BindAddr = ln.Addr().String()
+	config.Raft.Bootstrap = id == 0
+	if fn != nil {
+		fn(&config)
+	}
+
+	l, err := log.NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+		_ = os.RemoveAll(dataDir)
+	})
+	if config.Raft.Bootstrap {
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+	}
+	return l, ln.Addr().String()
+}
+
+func TestWatchCluster(t *testing.T) {
+	logs, _ := setupCluster(t, 3)
+	require.Eventually(t, func() bool {
+		servers, err := logs[2].GetServers()
+		return err == nil && len(servers) == 3
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	events, cancel, err := logs[2].WatchCluster()
+	require.NoError(t, err)
+	defer cancel()
+
+	event := <-events
+	require.Equal(t, api.ClusterEvent_STATE, event.Type)
+	require.Equal(t, 3, len(event.Servers))
+
+	require.NoError(t, logs[0].Leave("1"))
+	event = waitForEvent(t, events, api.ClusterEvent_SERVER_LEAVE, "1")
+	require.Equal(t, 2, len(event.Servers))
+
+	// the follower may report the old leader again before the new one
+	require.NoError(t, logs[0].TransferLeadership("", ""))
+	event = waitForEvent(t, events, api.ClusterEvent_LEADER_CHANGE, "2")
+	require.True(t, event.Server.IsLeader)
+
+	cancel()
+	_, ok := <-events
+	require.False(t, ok)
+}
+
+func waitForEvent(
+	t *testing.T,
+	events <-chan *api.ClusterEvent,
+	eventType api.ClusterEvent_Type,
+	id string,
+) *api.ClusterEvent {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == eventType && event.Server.Id == id {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event of %s", eventType, id)
+		}
+	}
+}
+
+func TestReplicatedCommands(t *testing.T) {
+	logs, _ := setupCluster(t, 3)
+
+	err := logs[0].SetConfig(log.MaxStoreBytesConfig, "32")
+	require.NoError(t, err)
+	// only new segments use the config, so start a new one
+	require.NoError(t, logs[0].DeleteTopic(""))
+	var off uint64
+	for i := 0; i < 3; i++ {
+		off, err = logs[0].Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, logs[0].Truncate(off))
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			if _, err := l.Read(off - 1); err == nil {
+				return false
+			}
+			if _, err := l.Read(off); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	require.NoError(t, logs[0].DeleteTopic(""))
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			if _, err := l.Read(off); err == nil {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	next, err := logs[0].Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, off+1, next)
+
+	require.Error(t, logs[0].SetConfig("unknown", "1"))
+	require.Error(t, logs[0].DeleteTopic("unknown"))
+}
+
+func TestCommitOffset(t *testing.T) {
+	logs, _ := setupCluster(t, 3)
+
+	_, err := logs[1].FetchOffset("group")
+	require.Equal(t, api.ErrNoCommittedOffset{Group: "group"}, err)
+
+	require.NoError(t, logs[0].CommitOffset(context.Background(), "group", 5))
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			offset, err := l.FetchOffset("group")
+			if err != nil || offset != 5 {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	require.Error(t, logs[1].CommitOffset(context.Background(), "group", 6))
+}
+
+func TestGetOffsets(t *testing.T) {
+	logs, _ := setupCluster(t, 3)
+
+	for i := 0; i < 3; i++ {
+		_, err := logs[0].Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	offsets, err := logs[0].GetOffsets()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.LowestOffset)
+	require.Equal(t, uint64(2), offsets.HighestOffset)
+	require.Equal(t, uint64(3), offsets.NextOffset)
+	require.NotZero(t, offsets.CommitIndex)
+	require.Equal(t, offsets.CommitIndex, offsets.AppliedIndex)
+
+	// the followers' offsets catch up with the leader's
+	require.Eventually(t, func() bool {
+		for _, l := range logs[1:] {
+			got, err := l.GetOffsets()
+			if err != nil ||
+				got.HighestOffset != offsets.HighestOffset ||
+				got.AppliedIndex < offsets.AppliedIndex {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+}
+
+func TestJoinPromotesCaughtUpNonvoter(t *testing.T) {
+	leader, _ := setupNode(t, 0, func(c *log.Config) {
+		c.Raft.PromotionLag = 1
+		c.Raft.PromotionInterval = 500 * time.Millisecond
+	})
+	for i := 0; i < 100; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	_, addr := setupNode(t, 1, nil)
+	require.NoError(t, leader.Join("1", addr))
+	servers, err := leader.GetServers()
+	require.NoError(t, err)
+	require.Equal(t, raft.Nonvoter.String(), servers[1].Suffrage)
+	waitForSuffrage(t, leader, "1", raft.Voter)
+
+	// a server that never catches up stays a nonvoter and doesn't count
+	// toward the quorum
+	unreachable := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+	require.NoError(t, leader.Join("2", unreachable))
+	time.Sleep(time.Second)
+	servers, err = leader.GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	require.Equal(t, raft.Nonvoter.String(), servers[2].Suffrage)
+	_, err = leader.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+}
+
+func TestNewLeaderPromotesNonvoters(t *testing.T) {
+	// the first leader never gets around to promoting the joined server
+	logs := make([]*log.DistributedLog, 5)
+	addrs := make([]string, 5)
+	logs[0], addrs[0] = setupNode(t, 0, func(c *log.Config) {
+		c.Raft.PromotionInterval = time.Hour
+	})
+	for i := 1; i < 5; i++ {
+		logs[i], addrs[i] = setupNode(t, i, nil)
+	}
+	for i := 1; i < 3; i++ {
+		require.NoError(t, logs[0].AddVoter(fmt.Sprintf("%d", i), addrs[i]))
+	}
+	require.NoError(t, logs[0].Join("3", addrs[3]))
+	require.NoError(t, logs[0].AddNonvoter("4", addrs[4]))
+
+	require.NoError(t, logs[0].TransferLeadership("1", addrs[1]))
+	waitForSuffrage(t, logs[1], "3", raft.Voter)
+
+	// the server an admin added as a nonvoter caught up too, but the new
+	// leader knows not to promote it
+	time.Sleep(500 * time.Millisecond)
+	waitForSuffrage(t, logs[1], "4", raft.Nonvoter)
+}
+
+func TestGetServersAppliedIndex(t *testing.T) {
+	logs, _ := setupCluster(t, 3)
+	for i := 0; i < 3; i++ {
+		_, err := logs[0].Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// the leader knows how far each follower got
+	stats, err := logs[0].RaftStats()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		servers, err := logs[0].GetServers()
+		if err != nil {
+			return false
+		}
+		for _, server := range servers {
+			if server.AppliedIndex < stats.AppliedIndex {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// a follower only knows its own index
+	require.Eventually(t, func() bool {
+		servers, err := logs[1].GetServers()
+		if err != nil {
+			return false
+		}
+		for _, server := range servers {
+			if (server.Id == "1") != (server.AppliedIndex != 0) {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestSnapshotInstallOnFreshFollower(t *testing.T) {
+	compact := func(c *log.Config) {
+		c.Segment.MaxStoreBytes = 64
+		c.Raft.TrailingLogs = 2
+		c.Raft.SnapshotThreshold = 1 << 20
+		c.Raft.SnapshotInterval = time.Hour
+	}
+	leader, _ := setupNode(t, 0, compact)
+
+	var offsets []uint64
+	for i := 0; i < 10; i++ {
+		off, err := leader.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		offsets = append(offsets, off)
+	}
+	_, err := leader.Snapshot()
+	require.NoError(t, err)
+
+	// the follower can't catch up from the compacted log and must install
+	// the snapshot, then keep appending from the leader's next index
+	follower, addr := setupNode(t, 1, compact)
+	require.NoError(t, leader.Join("1", addr))
+
+	for i := 0; i < 5; i++ {
+		off, err := leader.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		offsets = append(offsets, off)
+	}
+
+	require.Eventually(t, func() bool {
+		for _, off := range offsets {
+			record, err := follower.Read(off)
+			if err != nil || record.Offset != off {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+
+	stats, err := follower.RaftStats()
+	require.NoError(t, err)
+	require.Equal(t, stats.CommitIndex, stats.LastLogIndex)
+}
+
+func TestIdempotentAppend(t *testing.T) {
+	compact := func(c *log.Config) {
+		c.Segment.MaxStoreBytes = 64
+		c.Raft.TrailingLogs = 2
+		c.Raft.SnapshotThreshold = 1 << 20
+		c.Raft.SnapshotInterval = time.Hour
+	}
+	leader, _ := setupNode(t, 0, compact)
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+
+	first, err := leader.AppendProducer(ctx, "producer", 1, record)
+	require.NoError(t, err)
+	second, err := leader.AppendProducer(ctx, "producer", 2, record)
+	require.NoError(t, err)
+	require.Equal(t, first+1, second)
+
+	// the last sequence again returns its offset, the earlier ones and
+	// the gaps fail
+	off, err := leader.AppendProducer(ctx, "producer", 2, record)
+	require.NoError(t, err)
+	require.Equal(t, second, off)
+	_, err = leader.AppendProducer(ctx, "producer", 1, record)
+	require.Equal(t, api.ErrDuplicateSequence{
+		ProducerID: "producer",
+		Sequence:   1,
+	}, err)
+	_, err = leader.AppendProducer(ctx, "producer", 4, record)
+	require.Equal(t, api.ErrOutOfOrderSequence{
+		ProducerID: "producer",
+		Sequence:   4,
+		Expected:   3,
+	}, err)
+	_, err = leader.AppendProducer(ctx, "other", 2, record)
+	require.Equal(t, api.ErrOutOfOrderSequence{
+		ProducerID: "other",
+		Sequence:   2,
+		Expected:   1,
+	}, err)
+
+	// the producers' sequences reach a new follower in the snapshot, so
+	// they're still deduped once it leads
+	for i := 0; i < 5; i++ {
+		_, err := leader.Append(record)
+		require.NoError(t, err)
+	}
+	_, err = leader.Snapshot()
+	require.NoError(t, err)
+	follower, addr := setupNode(t, 1, compact)
+	require.NoError(t, leader.Join("1", addr))
+	waitForSuffrage(t, leader, "1", raft.Voter)
+	require.NoError(t, leader.TransferLeadership("1", addr))
+	require.Eventually(t, follower.IsLeader, 3*time.Second, 50*time.Millisecond)
+
+	off, err = follower.AppendProducer(ctx, "producer", 2, record)
+	require.NoError(t, err)
+	require.Equal(t, second, off)
+	off, err = follower.AppendProducer(ctx, "producer", 3, record)
+	require.NoError(t, err)
+	require.Greater(t, off, second+5)
+}
+
+func TestIdempotentProducersEvicted(t *testing.T) {
+	defer log.SetMaxProducers(2)()
+	leader, _ := setupNode(t, 0, nil)
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := leader.AppendProducer(ctx, id, 1, record)
+		require.NoError(t, err)
+	}
+	// the producer that appended least recently is forgotten
+	_, err := leader.AppendProducer(ctx, "a", 2, record)
+	require.Equal(t, api.ErrOutOfOrderSequence{
+		ProducerID: "a",
+		Sequence:   2,
+		Expected:   1,
+	}, err)
+	_, err = leader.AppendProducer(ctx, "b", 2, record)
+	require.NoError(t, err)
+}
+
+// TestRaftLogStore uses the log store through raft.LogStore, the way raft
+// does, storing, reading and deleting entries.
+func TestRaftLogStore(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, store raft.LogStore,
+	){
+		"first index":  testStoreFirstIndex,
+		"last index":   testStoreLastIndex,
+		"get log":      testStoreGetLog,
+		"set log":      testStoreSetLog,
+		"set logs":     testStoreSetLogs,
+		"delete range": testStoreDeleteRange,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "log-store-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			store, err := log.NewLogStore(
+				dir,
+				log.Config{},
+				raft.NewInmemStore(),
+			)
+			require.NoError(t, err)
+
+			fn(t, store)
+		})
+	}
+}
+
+func testStoreFirstIndex(t *testing.T, store raft.LogStore) {
+	idx, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), idx)
+
+	require.NoError(t, store.StoreLogs(testRaftLogs(1, 3)))
+	idx, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), idx)
+}
+
+func testStoreLastIndex(t *testing.T, store raft.LogStore) {
+	idx, err := store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), idx)
+
+	require.NoError(t, store.StoreLogs(testRaftLogs(1, 3)))
+	idx, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx)
+}
+
+func testStoreGetLog(t *testing.T, store raft.LogStore) {
+	got := &raft.Log{}
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(1, got))
+
+	logs := testRaftLogs(1, 3)
+	require.NoError(t, store.StoreLogs(logs))
+	require.NoError(t, store.GetLog(2, got))
+	requireRaftLog(t, logs[1], got)
+}
+
+func testStoreSetLog(t *testing.T, store raft.LogStore) {
+	want := &raft.Log{
+		Index:      1,
+		Term:       2,
+		Type:       raft.LogConfiguration,
+		Data:       []byte("log1"),
+		Extensions: []byte("extensions"),
+		AppendedAt: time.Now(),
+	}
+	require.NoError(t, store.StoreLog(want))
+
+	got := &raft.Log{}
+	require.NoError(t, store.GetLog(1, got))
+	requireRaftLog(t, want, got)
+}
+
+func testStoreSetLogs(t *testing.T, store raft.LogStore) {
+	logs := testRaftLogs(1, 2)
+	require.NoError(t, store.StoreLogs(logs))
+
+	for _, want := range logs {
+		got := &raft.Log{}
+		require.NoError(t, store.GetLog(want.Index, got))
+		requireRaftLog(t, want, got)
+	}
+}
+
+func testStoreDeleteRange(t *testing.T, store raft.LogStore) {
+	logs := testRaftLogs(1, 3)
+	require.NoError(t, store.StoreLogs(logs))
+
+	require.NoError(t, store.DeleteRange(1, 2))
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(1, &raft.Log{}))
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(2, &raft.Log{}))
+	got := &raft.Log{}
+	require.NoError(t, store.GetLog(3, got))
+	requireRaftLog(t, logs[2], got)
+}
+
+func testRaftLogs(first, last uint64) []*raft.Log {
+	var logs []*raft.Log
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{
+			Index:      i,
+			Term:       1,
+			Data:       []byte(fmt.Sprintf("log%d", i)),
+			AppendedAt: time.Now(),
+		})
+	}
+	return logs
+}
+
+// requireRaftLog compares the logs' appended at as instants, the stored log
+// loses the monotonic clock reading.
+func requireRaftLog(t *testing.T, want, got *raft.Log) {
+	t.Helper()
+	require.True(t, want.AppendedAt.Equal(got.AppendedAt),
+		"appended at: want %v, got %v", want.AppendedAt, got.AppendedAt)
+	w, g := *want, *got
+	w.AppendedAt, g.AppendedAt = time.Time{}, time.Time{}
+	require.Equal(t, w, g)
+}
+
+func TestPartitionedLog(t *testing.T) {
+	var logs []*log.PartitionedLog
+	nodeCount, partitions := 3, 3
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "partitioned-log-test")
+		require.NoError(t, err)
+
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]),
+		)
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+		config.Partition.BalanceInterval = 100 * time.Millisecond
+
+		l, err := log.NewPartitionedLog(dataDir, config, partitions)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = l.Close()
+			_ = os.RemoveAll(dataDir)
+		})
+
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		}
+		// every member handles the join, like with serf
+		for _, member := range logs {
+			err = member.Join(fmt.Sprintf("%d", i), ln.Addr().String())
+			if err != raft.ErrNotLeader {
+				require.NoError(t, err)
+			}
+		}
+		logs = append(logs, l)
+	}
+
+	// the partitions' leaders are spread across the servers
+	require.Eventually(t, func() bool {
+		servers, err := logs[0].GetServers()
+		if err != nil || len(servers) != nodeCount {
+			return false
+		}
+		for i, server := range servers {
+			if !reflect.DeepEqual(
+				[]uint32{uint32(i)},
+				server.LeaderPartitions,
+			) {
+				return false
+			}
+		}
+		return servers[0].IsLeader
+	}, 5*time.Second, 100*time.Millisecond)
+
+	for i := 0; i < partitions; i++ {
+		leader, err := logs[i].Partition(uint32(i))
+		require.NoError(t, err)
+		off, err := leader.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("partition %d", i)),
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+
+		require.Eventually(t, func() bool {
+			for _, l := range logs {
+				partition, err := l.Partition(uint32(i))
+				require.NoError(t, err)
+				record, err := partition.Read(off)
+				if err != nil || string(record.Value) !=
+					fmt.Sprintf("partition %d", i) {
+					return false
+				}
+			}
+			return true
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+
+	_, err := logs[0].Partition(uint32(partitions))
+	require.Error(t, err)
+}
+
+func TestApplyDeadline(t *testing.T) {
+	logs, _ := setupCluster(t, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	off, err := logs[0].AppendContext(ctx, &api.Record{
+		Value: []byte("hello world"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	ctx, cancel = context.WithDeadline(
+		context.Background(),
+		time.Now().Add(-time.Second),
+	)
+	defer cancel()
+	_, err = logs[0].AppendContext(ctx, &api.Record{
+		Value: []byte("hello world"),
+	})
+	require.Equal(t, context.DeadlineExceeded, err)
+}
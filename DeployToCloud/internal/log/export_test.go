@@ -0,0 +1,20 @@
+package log
+
+import "github.com/hashicorp/raft"
+
+// NewLogStore exposes the raft log store to the log_test package.
+func NewLogStore(
+	dir string,
+	c Config,
+	stable raft.StableStore,
+) (raft.LogStore, error) {
+	return newLogStore(dir, c, stable)
+}
+
+// SetMaxProducers sets how many idempotent producers the FSMs keep, the
+// returned func restores it.
+func SetMaxProducers(n int) func() {
+	old := maxProducers
+	maxProducers = n
+	return func() { maxProducers = old }
+}
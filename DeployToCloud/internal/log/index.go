@@ -84,6 +84,13 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// truncate keeps the first n entries.
+func (i *index) truncate(n uint64) {
+	if i.size > n*entWidth {
+		i.size = n * entWidth
+	}
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
@@ -130,9 +130,35 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
 	return l.setup()
 }
 
+// resetAt removes every record, the log continues at off. Unlike Reset it
+// holds the lock throughout, so readers never see the log without segments.
+func (l *Log) resetAt(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.segments {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = nil
+	l.Config.Segment.InitialOffset = off
+	return l.newSegment(off)
+}
+
+// configure changes the config under the lock, new segments pick it up.
+func (l *Log) configure(fn func(*Config)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fn(&l.Config)
+}
+
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -149,6 +175,29 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
+
+// GetOffsets returns the log's range and the offset of its next record,
+// read together so an append or truncate can't come in between.
+func (l *Log) GetOffsets() (*api.GetOffsetsResponse, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	next := l.segments[len(l.segments)-1].nextOffset
+	var highest uint64
+	if next != 0 {
+		highest = next - 1
+	}
+	return &api.GetOffsetsResponse{
+		LowestOffset:  l.segments[0].baseOffset,
+		HighestOffset: highest,
+		NextOffset:    l.activeSegment.nextOffset,
+	}, nil
+}
+
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -166,6 +215,33 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+// truncateFrom removes the records from off on, the log continues at off.
+func (l *Log) truncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset >= off {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		if s.nextOffset > off {
+			if err := s.truncate(off); err != nil {
+				return err
+			}
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	if len(segments) == 0 {
+		return l.newSegment(off)
+	}
+	l.activeSegment = segments[len(segments)-1]
+	return nil
+}
+
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -176,13 +252,15 @@ func (l *Log) Reader() io.Reader {
 	return io.MultiReader(readers...)
 }
 
+// originReader doesn't embed the store, the embedded *os.File's WriteTo
+// would have io.Copy read from the file's offset instead of off.
 type originReader struct {
-	*store
-	off int64
+	store *store
+	off   int64
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
+	n, err := o.store.ReadAt(p, o.off)
 	o.off += int64(n)
 	return n, err
 }
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"testing"
@@ -100,6 +101,12 @@ func testReader(t *testing.T, log *Log) {
 	err = proto.Unmarshal(b[lenWidth:], got)
 	require.NoError(t, err)
 	require.Equal(t, want.Value, got.Value)
+
+	// snapshots copy the reader into raft's sink
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, log.Reader())
+	require.NoError(t, err)
+	require.Equal(t, b, buf.Bytes())
 }
 
 func testTruncate(t *testing.T, log *Log) {
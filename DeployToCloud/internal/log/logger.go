@@ -0,0 +1,170 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	stdlog "log"
+
+	"github.com/hashicorp/go-hclog"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var _ hclog.Logger = (*hclogAdapter)(nil)
+
+// hclogAdapter has raft log through zap, raft's key-value pairs become zap
+// fields.
+type hclogAdapter struct {
+	root   *zap.Logger
+	logger *zap.Logger
+	name   string
+	args   []interface{}
+}
+
+func newHCLogAdapter(logger *zap.Logger, name string) *hclogAdapter {
+	return &hclogAdapter{
+		root:   logger,
+		logger: logger.Named(name),
+		name:   name,
+	}
+}
+
+func (l *hclogAdapter) Log(level hclog.Level, msg string, args ...interface{}) {
+	if ce := l.logger.Check(zapLevel(level), msg); ce != nil {
+		ce.Write(fields(args)...)
+	}
+}
+
+func (l *hclogAdapter) Trace(msg string, args ...interface{}) {
+	l.Log(hclog.Trace, msg, args...)
+}
+
+func (l *hclogAdapter) Debug(msg string, args ...interface{}) {
+	l.Log(hclog.Debug, msg, args...)
+}
+
+func (l *hclogAdapter) Info(msg string, args ...interface{}) {
+	l.Log(hclog.Info, msg, args...)
+}
+
+func (l *hclogAdapter) Warn(msg string, args ...interface{}) {
+	l.Log(hclog.Warn, msg, args...)
+}
+
+func (l *hclogAdapter) Error(msg string, args ...interface{}) {
+	l.Log(hclog.Error, msg, args...)
+}
+
+func (l *hclogAdapter) IsTrace() bool {
+	return l.logger.Core().Enabled(zapcore.DebugLevel)
+}
+
+func (l *hclogAdapter) IsDebug() bool {
+	return l.logger.Core().Enabled(zapcore.DebugLevel)
+}
+
+func (l *hclogAdapter) IsInfo() bool {
+	return l.logger.Core().Enabled(zapcore.InfoLevel)
+}
+
+func (l *hclogAdapter) IsWarn() bool {
+	return l.logger.Core().Enabled(zapcore.WarnLevel)
+}
+
+func (l *hclogAdapter) IsError() bool {
+	return l.logger.Core().Enabled(zapcore.ErrorLevel)
+}
+
+func (l *hclogAdapter) ImpliedArgs() []interface{} {
+	return l.args
+}
+
+func (l *hclogAdapter) With(args ...interface{}) hclog.Logger {
+	return &hclogAdapter{
+		root:   l.root,
+		logger: l.logger.With(fields(args)...),
+		name:   l.name,
+		args:   append(append([]interface{}{}, l.args...), args...),
+	}
+}
+
+func (l *hclogAdapter) Name() string {
+	return l.name
+}
+
+func (l *hclogAdapter) Named(name string) hclog.Logger {
+	named := name
+	if l.name != "" {
+		named = l.name + "." + name
+	}
+	return &hclogAdapter{
+		root:   l.root,
+		logger: l.logger.Named(name),
+		name:   named,
+		args:   l.args,
+	}
+}
+
+func (l *hclogAdapter) ResetNamed(name string) hclog.Logger {
+	return &hclogAdapter{
+		root:   l.root,
+		logger: l.root.Named(name).With(fields(l.args)...),
+		name:   name,
+		args:   l.args,
+	}
+}
+
+// SetLevel does nothing, zap's core decides what's logged.
+func (l *hclogAdapter) SetLevel(hclog.Level) {}
+
+// GetLevel returns the lowest level zap's core logs.
+func (l *hclogAdapter) GetLevel() hclog.Level {
+	switch {
+	case l.IsTrace():
+		return hclog.Trace
+	case l.IsInfo():
+		return hclog.Info
+	case l.IsWarn():
+		return hclog.Warn
+	case l.IsError():
+		return hclog.Error
+	}
+	return hclog.Off
+}
+
+func (l *hclogAdapter) StandardLogger(
+	*hclog.StandardLoggerOptions,
+) *stdlog.Logger {
+	return zap.NewStdLog(l.logger)
+}
+
+func (l *hclogAdapter) StandardWriter(
+	*hclog.StandardLoggerOptions,
+) io.Writer {
+	return zap.NewStdLog(l.logger).Writer()
+}
+
+func zapLevel(level hclog.Level) zapcore.Level {
+	switch level {
+	case hclog.Trace, hclog.Debug:
+		return zapcore.DebugLevel
+	case hclog.Warn:
+		return zapcore.WarnLevel
+	case hclog.Error:
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.InfoLevel
+	}
+}
+
+func fields(args []interface{}) []zap.Field {
+	var fs []zap.Field
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fs = append(fs, zap.Any("EXTRA_VALUE_AT_END", args[i]))
+			break
+		}
+		fs = append(fs, zap.Any(fmt.Sprint(args[i]), args[i+1]))
+	}
+	return fs
+}
@@ -0,0 +1,35 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHCLogAdapter(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	var logger hclog.Logger = newHCLogAdapter(zap.New(core), "raft")
+
+	require.False(t, logger.IsDebug())
+	require.True(t, logger.IsWarn())
+	logger.Debug("dropped")
+
+	logger = logger.Named("net").With("peer", "1")
+	require.Equal(t, "raft.net", logger.Name())
+	logger.Warn("failed to heartbeat", "error", "timeout", "extra")
+
+	require.Equal(t, 1, logs.Len())
+	entry := logs.All()[0]
+	require.Equal(t, zapcore.WarnLevel, entry.Level)
+	require.Equal(t, "raft.net", entry.LoggerName)
+	require.Equal(t, "failed to heartbeat", entry.Message)
+	require.Equal(t, map[string]interface{}{
+		"peer":               "1",
+		"error":              "timeout",
+		"EXTRA_VALUE_AT_END": "extra",
+	}, entry.ContextMap())
+}
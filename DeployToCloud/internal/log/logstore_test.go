@@ -0,0 +1,139 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogStore(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, store *logStore,
+	){
+		"empty store has no indexes":         testLogStoreEmpty,
+		"store honors the first index":       testLogStoreFirstIndex,
+		"store after a gap resets the log":   testLogStoreGap,
+		"store an existing index overwrites": testLogStoreOverwrite,
+		"delete a prefix and a suffix":       testLogStoreDeleteRange,
+		"get a missing log fails":            testLogStoreNotFound,
+		"first index survives a restart":     testLogStoreReopen,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "log-store-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			store, err := newLogStore(dir, c, raft.NewInmemStore())
+			require.NoError(t, err)
+
+			fn(t, store)
+		})
+	}
+}
+
+func testLogStoreEmpty(t *testing.T, store *logStore) {
+	requireIndexes(t, store, 0, 0)
+}
+
+func testLogStoreFirstIndex(t *testing.T, store *logStore) {
+	storeLogs(t, store, 1, 3)
+	requireIndexes(t, store, 1, 3)
+	requireLog(t, store, 2)
+
+	require.Error(t, store.StoreLog(&raft.Log{Index: 0}))
+}
+
+func testLogStoreGap(t *testing.T, store *logStore) {
+	storeLogs(t, store, 1, 3)
+	// a snapshot covering 1-9 was installed
+	storeLogs(t, store, 10, 11)
+	requireIndexes(t, store, 10, 11)
+	requireLog(t, store, 11)
+}
+
+func testLogStoreOverwrite(t *testing.T, store *logStore) {
+	storeLogs(t, store, 1, 5)
+	require.NoError(t, store.StoreLog(&raft.Log{
+		Index: 3,
+		Term:  2,
+		Data:  []byte("overwrite"),
+	}))
+	requireIndexes(t, store, 1, 3)
+	out := &raft.Log{}
+	require.NoError(t, store.GetLog(3, out))
+	require.Equal(t, uint64(2), out.Term)
+	require.Equal(t, []byte("overwrite"), out.Data)
+}
+
+func testLogStoreDeleteRange(t *testing.T, store *logStore) {
+	storeLogs(t, store, 1, 10)
+
+	// conflicting entries
+	require.NoError(t, store.DeleteRange(8, 10))
+	requireIndexes(t, store, 1, 7)
+	storeLogs(t, store, 8, 9)
+
+	// compaction hides the entries left in partially deleted segments
+	require.NoError(t, store.DeleteRange(1, 4))
+	requireIndexes(t, store, 5, 9)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(4, &raft.Log{}))
+	requireLog(t, store, 5)
+
+	require.NoError(t, store.DeleteRange(5, 9))
+	requireIndexes(t, store, 0, 0)
+	storeLogs(t, store, 10, 10)
+	requireIndexes(t, store, 10, 10)
+}
+
+func testLogStoreReopen(t *testing.T, store *logStore) {
+	storeLogs(t, store, 1, 10)
+	require.NoError(t, store.DeleteRange(1, 4))
+	requireIndexes(t, store, 5, 10)
+	require.NoError(t, store.Close())
+
+	// the entries left in the partially deleted segment stay hidden
+	store, err := newLogStore(store.Dir, store.Config, store.stable)
+	require.NoError(t, err)
+	requireIndexes(t, store, 5, 10)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(4, &raft.Log{}))
+}
+
+func testLogStoreNotFound(t *testing.T, store *logStore) {
+	storeLogs(t, store, 1, 2)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(3, &raft.Log{}))
+}
+
+func storeLogs(t *testing.T, store *logStore, first, last uint64) {
+	t.Helper()
+	var logs []*raft.Log
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{
+			Index: i,
+			Term:  1,
+			Data:  []byte("hello world"),
+		})
+	}
+	require.NoError(t, store.StoreLogs(logs))
+}
+
+func requireIndexes(t *testing.T, store *logStore, first, last uint64) {
+	t.Helper()
+	got, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, first, got)
+	got, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, last, got)
+}
+
+func requireLog(t *testing.T, store *logStore, index uint64) {
+	t.Helper()
+	out := &raft.Log{}
+	require.NoError(t, store.GetLog(index, out))
+	require.Equal(t, index, out.Index)
+	require.Equal(t, []byte("hello world"), out.Data)
+}
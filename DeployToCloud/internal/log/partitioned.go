@@ -0,0 +1,246 @@
+package log
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+)
+
+// PartitionedLog splits the log into partitions, each a DistributedLog with
+// its own Raft group. Every server is a member of every partition's group
+// and the partitions' leaders are spread across the servers so writes
+// aren't all handled by one server.
+type PartitionedLog struct {
+	localID    raft.ServerID
+	partitions []*DistributedLog
+
+	balanceMu sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPartitionedLog sets up the partitions' logs. Partition 0 keeps its data
+// in dataDir, the other partitions in dataDir/partitions/<partition>.
+func NewPartitionedLog(dataDir string, config Config, partitions int) (
+	*PartitionedLog,
+	error,
+) {
+	if partitions < 1 || partitions > 256 {
+		return nil, fmt.Errorf("invalid partition count: %d", partitions)
+	}
+	p := &PartitionedLog{
+		localID: config.Raft.LocalID,
+		closed:  make(chan struct{}),
+	}
+	for i := 0; i < partitions; i++ {
+		c := config
+		dir := dataDir
+		if i != 0 {
+			c.Raft.StreamLayer = config.Raft.StreamLayer.Partition(uint8(i))
+			dir = filepath.Join(dataDir, "partitions", strconv.Itoa(i))
+		}
+		l, err := NewDistributedLog(dir, c)
+		if err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+		p.partitions = append(p.partitions, l)
+	}
+	if partitions > 1 {
+		interval := config.Partition.BalanceInterval
+		if interval == 0 {
+			interval = 10 * time.Second
+		}
+		go p.balanceEvery(interval)
+	}
+	return p, nil
+}
+
+// Partition returns the partition's log.
+func (p *PartitionedLog) Partition(partition uint32) (*DistributedLog, error) {
+	if partition >= uint32(len(p.partitions)) {
+		return nil, fmt.Errorf("unknown partition: %d", partition)
+	}
+	return p.partitions[partition], nil
+}
+
+func (p *PartitionedLog) Partitions() []*DistributedLog {
+	return p.partitions
+}
+
+// Join adds the server to every partition this server leads and then moves
+// leadership so each server leads its share of the partitions.
+func (p *PartitionedLog) Join(id, addr string) error {
+	if err := p.each(func(l *DistributedLog) error {
+		return l.Join(id, addr)
+	}); err != nil {
+		return err
+	}
+	return p.balance()
+}
+
+// Leave removes the server from every partition this server leads.
+func (p *PartitionedLog) Leave(id string) error {
+	return p.each(func(l *DistributedLog) error {
+		return l.Leave(id)
+	})
+}
+
+// each calls fn on the partitions and returns raft.ErrNotLeader if this
+// server leads none of them.
+func (p *PartitionedLog) each(fn func(*DistributedLog) error) error {
+	led := false
+	for _, l := range p.partitions {
+		err := fn(l)
+		if err == raft.ErrNotLeader {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		led = true
+	}
+	if !led {
+		return raft.ErrNotLeader
+	}
+	return nil
+}
+
+// balanceEvery keeps balancing the partitions, a transfer can fail or
+// leadership can move back after an election.
+func (p *PartitionedLog) balanceEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+			_ = p.balance()
+		}
+	}
+}
+
+// balance syncs the servers of the partitions this server leads with
+// partition 0's, in case a partition missed a join or leave while its
+// leadership moved, and transfers their leadership so partition i is led
+// by the i-th voter, modulo the voter count, sorted by id. Only partition
+// 0's leader syncs, a follower's configuration may trail it and miss a
+// server that just joined.
+func (p *PartitionedLog) balance() error {
+	if len(p.partitions) == 1 {
+		return nil
+	}
+	p.balanceMu.Lock()
+	defer p.balanceMu.Unlock()
+	syncing := p.partitions[0].IsLeader()
+	members, err := p.partitions[0].configuration()
+	if err != nil {
+		return err
+	}
+	for i, l := range p.partitions {
+		if !l.IsLeader() {
+			continue
+		}
+		if i != 0 && syncing {
+			if err = l.syncServers(members); err != nil {
+				return err
+			}
+		}
+		servers, err := l.configuration()
+		if err != nil {
+			return err
+		}
+		var voters []raft.Server
+		for _, srv := range servers {
+			if srv.Suffrage == raft.Voter {
+				voters = append(voters, srv)
+			}
+		}
+		if len(voters) == 0 {
+			continue
+		}
+		sort.Slice(voters, func(i, j int) bool {
+			return voters[i].ID < voters[j].ID
+		})
+		target := voters[i%len(voters)]
+		if target.ID == p.localID {
+			continue
+		}
+		err = l.TransferLeadership(string(target.ID), string(target.Address))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetServers returns partition 0's servers with the partitions each of them
+// leads.
+func (p *PartitionedLog) GetServers() ([]*api.Server, error) {
+	servers, err := p.partitions[0].GetServers()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*api.Server)
+	for _, server := range servers {
+		byID[server.Id] = server
+	}
+	for i, l := range p.partitions {
+		partitionServers, err := l.GetServers()
+		if err != nil {
+			return nil, err
+		}
+		for _, server := range partitionServers {
+			if !server.IsLeader {
+				continue
+			}
+			if s, ok := byID[server.Id]; ok {
+				s.LeaderPartitions = append(s.LeaderPartitions, uint32(i))
+			}
+		}
+	}
+	return servers, nil
+}
+
+func (p *PartitionedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out")
+		case <-ticker.C:
+			elected := true
+			for _, l := range p.partitions {
+				if l.raft.Leader() == "" {
+					elected = false
+				}
+			}
+			if elected {
+				return nil
+			}
+		}
+	}
+}
+
+func (p *PartitionedLog) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	p.balanceMu.Lock()
+	defer p.balanceMu.Unlock()
+	var err error
+	for _, l := range p.partitions {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
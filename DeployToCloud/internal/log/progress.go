@@ -0,0 +1,177 @@
+package log
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var (
+	_ raft.Transport      = (*progressTransport)(nil)
+	_ raft.WithClose      = (*progressTransport)(nil)
+	_ raft.AppendPipeline = (*progressPipeline)(nil)
+)
+
+// progressTransport records the last index each peer acknowledged and when
+// it last answered. Raft doesn't expose the leader's match indexes or
+// contacts, so the leader reads them from here to decide when a nonvoter has
+// caught up and to report its peers' last contact.
+type progressTransport struct {
+	*raft.NetworkTransport
+
+	mu      sync.Mutex
+	match   map[raft.ServerID]uint64
+	contact map[raft.ServerID]time.Time
+}
+
+func newProgressTransport(t *raft.NetworkTransport) *progressTransport {
+	return &progressTransport{
+		NetworkTransport: t,
+		match:            make(map[raft.ServerID]uint64),
+		contact:          make(map[raft.ServerID]time.Time),
+	}
+}
+
+// matchIndex returns the last index the peer is known to have stored.
+func (t *progressTransport) matchIndex(id raft.ServerID) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	index, ok := t.match[id]
+	return index, ok
+}
+
+// forget drops the peer's progress, a server that's added again may have
+// lost its log.
+func (t *progressTransport) forget(id raft.ServerID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.match, id)
+	delete(t.contact, id)
+}
+
+// lastContact returns when the peer last answered an append, heartbeat or
+// snapshot.
+func (t *progressTransport) lastContact(id raft.ServerID) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok := t.contact[id]
+	return last, ok
+}
+
+func (t *progressTransport) touch(id raft.ServerID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.contact[id] = time.Now()
+}
+
+func (t *progressTransport) record(id raft.ServerID, index uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if index > t.match[id] {
+		t.match[id] = index
+	}
+}
+
+// recordAppend records the peer's answer and the entries a successful
+// append stored, heartbeats carry no entries and say nothing about the
+// peer's log.
+func (t *progressTransport) recordAppend(
+	id raft.ServerID,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) {
+	t.touch(id)
+	if !resp.Success || len(args.Entries) == 0 {
+		return
+	}
+	t.record(id, args.Entries[len(args.Entries)-1].Index)
+}
+
+func (t *progressTransport) AppendEntries(
+	id raft.ServerID,
+	target raft.ServerAddress,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) error {
+	err := t.NetworkTransport.AppendEntries(id, target, args, resp)
+	if err == nil {
+		t.recordAppend(id, args, resp)
+	}
+	return err
+}
+
+func (t *progressTransport) AppendEntriesPipeline(
+	id raft.ServerID,
+	target raft.ServerAddress,
+) (raft.AppendPipeline, error) {
+	pipeline, err := t.NetworkTransport.AppendEntriesPipeline(id, target)
+	if err != nil {
+		return nil, err
+	}
+	p := &progressPipeline{
+		AppendPipeline: pipeline,
+		transport:      t,
+		id:             id,
+		doneCh:         make(chan raft.AppendFuture),
+		closed:         make(chan struct{}),
+	}
+	go p.consume()
+	return p, nil
+}
+
+func (t *progressTransport) InstallSnapshot(
+	id raft.ServerID,
+	target raft.ServerAddress,
+	args *raft.InstallSnapshotRequest,
+	resp *raft.InstallSnapshotResponse,
+	data io.Reader,
+) error {
+	err := t.NetworkTransport.InstallSnapshot(id, target, args, resp, data)
+	if err == nil {
+		t.touch(id)
+	}
+	if err == nil && resp.Success {
+		t.record(id, args.LastLogIndex)
+	}
+	return err
+}
+
+// progressPipeline records the pipelined appends' responses before handing
+// them to raft.
+type progressPipeline struct {
+	raft.AppendPipeline
+	transport *progressTransport
+	id        raft.ServerID
+	doneCh    chan raft.AppendFuture
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *progressPipeline) consume() {
+	for {
+		select {
+		case future := <-p.AppendPipeline.Consumer():
+			if future.Error() == nil {
+				p.transport.recordAppend(p.id, future.Request(), future.Response())
+			}
+			select {
+			case p.doneCh <- future:
+			case <-p.closed:
+				return
+			}
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *progressPipeline) Consumer() <-chan raft.AppendFuture {
+	return p.doneCh
+}
+
+func (p *progressPipeline) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return p.AppendPipeline.Close()
+}
@@ -89,6 +89,20 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
+// truncate removes the records from off on, off must be in the segment.
+func (s *segment) truncate(off uint64) error {
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return err
+	}
+	if err = s.store.truncate(pos); err != nil {
+		return err
+	}
+	s.index.truncate(off - s.baseOffset)
+	s.nextOffset = off
+	return nil
+}
+
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
 		s.index.size >= s.config.Segment.MaxIndexBytes
@@ -0,0 +1,202 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+var _ raft.StableStore = (*stableStore)(nil)
+
+// raft checks for this message when it reads a key that was never set.
+var errKeyNotFound = errors.New("not found")
+
+const checksumWidth = 4
+
+const (
+	// stableFile is the stable store's file in the raft dir.
+	stableFile = "stable.dat"
+	// boltStableFile is the BoltDB file raft's metadata was kept in before.
+	boltStableFile = "stable"
+)
+
+// stableStore stores raft's metadata, like the current term and the last
+// vote, in a file. The file holds each key and value prefixed by its
+// length, like the store's records, followed by a CRC-32 checksum of them.
+// Every Set rewrites a temporary file, syncs it and renames it over the
+// file, so a crash leaves either the old or the new contents on disk.
+type stableStore struct {
+	mu   sync.Mutex
+	path string
+	kv   map[string][]byte
+}
+
+// openStableStore opens the stable store in the raft dir. A dir that only
+// has the BoltDB stable store fails to open, starting without its term and
+// vote could have the server vote twice in a term. The README describes
+// how to upgrade such a server.
+func openStableStore(dir string) (*stableStore, error) {
+	path := filepath.Join(dir, stableFile)
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		boltPath := filepath.Join(dir, boltStableFile)
+		if _, err = os.Stat(boltPath); err == nil {
+			return nil, fmt.Errorf(
+				"found the BoltDB stable store %s, remove the server "+
+					"and its raft dir and join it again to upgrade",
+				boltPath,
+			)
+		}
+	}
+	return newStableStore(path)
+}
+
+func newStableStore(path string) (*stableStore, error) {
+	s := &stableStore{
+		path: path,
+		kv:   make(map[string][]byte),
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = s.decode(b); err != nil {
+		return nil, fmt.Errorf("stable store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *stableStore) Set(key []byte, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.kv[string(key)]
+	s.kv[string(key)] = append([]byte(nil), val...)
+	if err := s.persist(); err != nil {
+		if ok {
+			s.kv[string(key)] = old
+		} else {
+			delete(s.kv, string(key))
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *stableStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.kv[string(key)]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+func (s *stableStore) SetUint64(key []byte, val uint64) error {
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, val)
+	return s.Set(key, b)
+}
+
+func (s *stableStore) GetUint64(key []byte) (uint64, error) {
+	b, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != lenWidth {
+		return 0, fmt.Errorf("invalid uint64 value for key %q", key)
+	}
+	return enc.Uint64(b), nil
+}
+
+func (s *stableStore) persist() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(s.encode()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	// sync the directory so the rename itself is durable
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	if err = dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+func (s *stableStore) encode() []byte {
+	keys := make([]string, 0, len(s.kv))
+	for k := range s.kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b []byte
+	for _, k := range keys {
+		b = enc.AppendUint64(b, uint64(len(k)))
+		b = append(b, k...)
+		b = enc.AppendUint64(b, uint64(len(s.kv[k])))
+		b = append(b, s.kv[k]...)
+	}
+	return enc.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+func (s *stableStore) decode(b []byte) error {
+	if len(b) < checksumWidth {
+		return fmt.Errorf("missing checksum")
+	}
+	b, sum := b[:len(b)-checksumWidth], enc.Uint32(b[len(b)-checksumWidth:])
+	if crc32.ChecksumIEEE(b) != sum {
+		return fmt.Errorf("checksum mismatch")
+	}
+	next := func() ([]byte, error) {
+		if len(b) < lenWidth {
+			return nil, fmt.Errorf("truncated entry")
+		}
+		n := enc.Uint64(b)
+		b = b[lenWidth:]
+		if uint64(len(b)) < n {
+			return nil, fmt.Errorf("truncated entry")
+		}
+		p := b[:n]
+		b = b[n:]
+		return p, nil
+	}
+	for len(b) > 0 {
+		key, err := next()
+		if err != nil {
+			return err
+		}
+		val, err := next()
+		if err != nil {
+			return err
+		}
+		s.kv[string(key)] = append([]byte(nil), val...)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStableStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stable-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stable")
+
+	s, err := newStableStore(path)
+	require.NoError(t, err)
+
+	_, err = s.Get([]byte("missing"))
+	require.Equal(t, errKeyNotFound, err)
+	_, err = s.GetUint64([]byte("missing"))
+	require.Equal(t, errKeyNotFound, err)
+
+	require.NoError(t, s.Set([]byte("key"), []byte("value")))
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 3))
+	require.NoError(t, s.Set([]byte("key"), []byte("overwritten")))
+
+	// reopening the store reads back what was set
+	s, err = newStableStore(path)
+	require.NoError(t, err)
+	val, err := s.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("overwritten"), val)
+	term, err := s.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), term)
+
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestStableStoreCorrupted(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stable-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stable")
+
+	s, err := newStableStore(path)
+	require.NoError(t, err)
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 3))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[lenWidth] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	_, err = newStableStore(path)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, b[:2], 0644))
+	_, err = newStableStore(path)
+	require.Error(t, err)
+}
+
+func TestStableStoreRefusesBolt(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stable-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a raft dir written before the stable store replaced BoltDB
+	boltPath := filepath.Join(dir, boltStableFile)
+	require.NoError(t, os.WriteFile(boltPath, []byte("bolt"), 0600))
+	_, err = openStableStore(dir)
+	require.Error(t, err)
+
+	// once the store exists the leftover Bolt file is ignored
+	s, err := newStableStore(filepath.Join(dir, stableFile))
+	require.NoError(t, err)
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 5))
+	_, err = openStableStore(dir)
+	require.NoError(t, err)
+}
@@ -0,0 +1,86 @@
+package log
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+
+	"github.com/igor-baiborodine/proglog/internal/config"
+)
+
+func TestStreamLayer(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	stream := NewStreamLayer(ln, serverTLSConfig, peerTLSConfig)
+	stream.mux.handshakeTimeout = 200 * time.Millisecond
+	partition := stream.Partition(1)
+	defer func() {
+		require.NoError(t, partition.Close())
+		require.NoError(t, stream.Close())
+	}()
+	addr := ln.Addr().String()
+
+	// an idle connection doesn't hold up the others and is dropped once
+	// its handshake times out
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+
+	// a connection that isn't a raft rpc is dropped without failing Accept
+	junk, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer junk.Close()
+	_, err = junk.Write([]byte("junk"))
+	require.NoError(t, err)
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := partition.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := partition.Dial(raft.ServerAddress(addr), time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	select {
+	case server := <-accepted:
+		defer server.Close()
+		b := make([]byte, 5)
+		_, err = server.Read(b)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), b)
+	case <-time.After(time.Second):
+		t.Fatal("raft connection wasn't accepted")
+	}
+
+	for _, c := range []net.Conn{idle, junk} {
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err = c.Read(make([]byte, 1))
+		require.Error(t, err)
+		netErr, ok := err.(net.Error)
+		require.False(t, ok && netErr.Timeout(), "connection wasn't dropped")
+	}
+}
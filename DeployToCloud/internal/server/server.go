@@ -10,6 +10,7 @@ import (
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"github.com/hashicorp/raft"
 
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/stats/view"
@@ -29,15 +30,28 @@ import (
 )
 
 type Config struct {
-	CommitLog   CommitLog
-	Authorizer  Authorizer
-	GetServerer GetServerer
+	CommitLog CommitLog
+	// Partitions holds each partition's log when the log is partitioned,
+	// otherwise CommitLog is the only partition.
+	Partitions   []CommitLog
+	Authorizer   Authorizer
+	GetServerer  GetServerer
+	MemberLister MemberLister
+	// ClusterWatcher, OffsetStore and Administrator serve partition 0, the
+	// other partitions' logs serve their own calls when they implement the
+	// interfaces.
+	ClusterWatcher ClusterWatcher
+	OffsetStore    OffsetStore
+	Administrator  Administrator
+	// Keyring rotates the gossip's encryption key across the cluster.
+	Keyring Keyring
 }
 
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	adminAction    = "admin"
 )
 
 type grpcServer struct {
@@ -106,6 +120,10 @@ func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (
 		return nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
+	api.RegisterAdminServer(gsrv, &adminServer{
+		config,
+		&api.UnimplementedAdminServer{},
+	})
 	return gsrv, nil
 }
 
@@ -118,13 +136,49 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	commitLog, err := s.commitLog(req.Partition)
 	if err != nil {
 		return nil, err
 	}
+	var offset uint64
+	if req.ProducerId != "" {
+		l, ok := commitLog.(ProducerAppender)
+		if !ok {
+			return nil, status.Error(
+				codes.Unimplemented,
+				"idempotent produce not supported",
+			)
+		}
+		offset, err = l.AppendProducer(
+			ctx,
+			req.ProducerId,
+			req.Sequence,
+			req.Record,
+		)
+	} else if l, ok := commitLog.(ContextAppender); ok {
+		offset, err = l.AppendContext(ctx, req.Record)
+	} else {
+		offset, err = commitLog.Append(req.Record)
+	}
+	if err != nil {
+		return nil, leaderError(req.Partition, err)
+	}
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+// leaderError tells the client to retry a write this server rejected
+// because it doesn't lead the partition. A leader that lost its leadership
+// meanwhile may still have replicated the write, so it's only Unavailable.
+func leaderError(partition uint32, err error) error {
+	switch err {
+	case raft.ErrNotLeader, raft.ErrLeadershipTransferInProgress:
+		return api.ErrNotLeader{Partition: partition}
+	case raft.ErrLeadershipLost:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse, error) {
 	if err := s.Authorizer.Authorize(
@@ -134,13 +188,135 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	commitLog, err := s.commitLog(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if req.Batch {
+		records, err := readBatch(commitLog, req)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ConsumeResponse{Records: records}, nil
+	}
+	record, err := commitLog.Read(req.Offset)
 	if err != nil {
 		return nil, api.ErrOffsetOutOfRange{Offset: req.Offset}
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+const defaultMaxRecords = 100
+
+// readBatch reads the records from the request's offset until it reaches
+// the request's limits, its end offset or the end of the log. The batch has
+// at least one record, so a record bigger than max bytes is still read. It
+// returns ErrOffsetOutOfRange when there's no record at the offset, and the
+// log's other errors as they are.
+func readBatch(
+	commitLog CommitLog,
+	req *api.ConsumeRequest,
+) ([]*api.Record, error) {
+	maxRecords := req.MaxRecords
+	if maxRecords == 0 {
+		maxRecords = defaultMaxRecords
+	}
+	var records []*api.Record
+	var size uint64
+	for offset := req.Offset; uint64(len(records)) < maxRecords; offset++ {
+		if req.EndOffset != nil && offset >= *req.EndOffset {
+			break
+		}
+		record, err := commitLog.Read(offset)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		size += uint64(len(record.Value))
+		if req.MaxBytes != 0 && size > req.MaxBytes && len(records) != 0 {
+			break
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil, api.ErrOffsetOutOfRange{Offset: req.Offset}
+	}
+	return records, nil
+}
+
+func (c *Config) commitLog(partition uint32) (CommitLog, error) {
+	if len(c.Partitions) == 0 && partition == 0 {
+		return c.CommitLog, nil
+	}
+	if partition >= uint32(len(c.Partitions)) {
+		return nil, status.Errorf(
+			codes.NotFound, "unknown partition: %d", partition,
+		)
+	}
+	return c.Partitions[partition], nil
+}
+
+// offsetStore returns the partition's offset store, OffsetStore for
+// partition 0 and the partition's log for the others.
+func (c *Config) offsetStore(partition uint32) (OffsetStore, error) {
+	var store OffsetStore
+	if partition == 0 {
+		store = c.OffsetStore
+	} else {
+		commitLog, err := c.commitLog(partition)
+		if err != nil {
+			return nil, err
+		}
+		store, _ = commitLog.(OffsetStore)
+	}
+	if store == nil {
+		return nil, status.Error(codes.Unimplemented, "offsets not supported")
+	}
+	return store, nil
+}
+
+// clusterWatcher returns the partition's cluster watcher, ClusterWatcher
+// for partition 0 and the partition's log for the others.
+func (c *Config) clusterWatcher(partition uint32) (ClusterWatcher, error) {
+	var watcher ClusterWatcher
+	if partition == 0 {
+		watcher = c.ClusterWatcher
+	} else {
+		commitLog, err := c.commitLog(partition)
+		if err != nil {
+			return nil, err
+		}
+		watcher, _ = commitLog.(ClusterWatcher)
+	}
+	if watcher == nil {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"cluster watch not supported",
+		)
+	}
+	return watcher, nil
+}
+
+// administrator returns the partition's administrator, Administrator for
+// partition 0 and the partition's log for the others.
+func (c *Config) administrator(partition uint32) (Administrator, error) {
+	var admin Administrator
+	if partition == 0 {
+		admin = c.Administrator
+	} else {
+		commitLog, err := c.commitLog(partition)
+		if err != nil {
+			return nil, err
+		}
+		admin, _ = commitLog.(Administrator)
+	}
+	if admin == nil {
+		return nil, status.Error(codes.Unimplemented, "admin not supported")
+	}
+	return admin, nil
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -157,11 +333,26 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 
+const (
+	// minTailBackoff is how long ConsumeStream first waits for the next
+	// record once it's sent the log's records, it doubles up to
+	// maxTailBackoff until a record comes.
+	minTailBackoff = 10 * time.Millisecond
+	maxTailBackoff = 250 * time.Millisecond
+)
+
+// ConsumeStream sends the records from the request's offset, waiting for
+// the records past the end of the log to be appended. It fails when the
+// offset's records were truncated.
 func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	backoff := minTailBackoff
 	for {
+		if req.EndOffset != nil && req.Offset >= *req.EndOffset {
+			return nil
+		}
 		select {
 		case <-stream.Context().Done():
 			return nil
@@ -169,7 +360,20 @@ func (s *grpcServer) ConsumeStream(
 			res, err := s.Consume(stream.Context(), req)
 			switch err.(type) {
 			case nil:
+				backoff = minTailBackoff
 			case api.ErrOffsetOutOfRange:
+				if s.truncated(req) {
+					return err
+				}
+				select {
+				case <-stream.Context().Done():
+					return nil
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > maxTailBackoff {
+					backoff = maxTailBackoff
+				}
 				continue
 			default:
 				return err
@@ -177,11 +381,100 @@ func (s *grpcServer) ConsumeStream(
 			if err = stream.Send(res); err != nil {
 				return err
 			}
-			req.Offset++
+			if req.Batch {
+				req.Offset = res.Records[len(res.Records)-1].Offset + 1
+			} else {
+				req.Offset++
+			}
 		}
 	}
 }
 
+// truncated reports whether the request's offset is before the log's
+// lowest offset, so its records won't ever be appended. A log that doesn't
+// report its offsets is never truncated.
+func (s *grpcServer) truncated(req *api.ConsumeRequest) bool {
+	commitLog, err := s.commitLog(req.Partition)
+	if err != nil {
+		return false
+	}
+	l, ok := commitLog.(OffsetGetter)
+	if !ok {
+		return false
+	}
+	offsets, err := l.GetOffsets()
+	return err == nil && req.Offset < offsets.LowestOffset
+}
+
+func (s *grpcServer) CommitOffset(
+	ctx context.Context, req *api.CommitOffsetRequest,
+) (
+	*api.CommitOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing group")
+	}
+	store, err := s.offsetStore(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	err = store.CommitOffset(ctx, req.Group, req.Offset)
+	if err != nil {
+		return nil, leaderError(req.Partition, err)
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(
+	ctx context.Context, req *api.FetchOffsetRequest,
+) (
+	*api.FetchOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	store, err := s.offsetStore(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := store.FetchOffset(req.Group)
+	if err != nil {
+		return nil, leaderError(req.Partition, err)
+	}
+	return &api.FetchOffsetResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) GetOffsets(
+	ctx context.Context, req *api.GetOffsetsRequest,
+) (
+	*api.GetOffsetsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	commitLog, err := s.commitLog(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := commitLog.(OffsetGetter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "offsets not supported")
+	}
+	return l.GetOffsets()
+}
+
 func (s *grpcServer) GetServers(
 	ctx context.Context, req *api.GetServersRequest,
 ) (
@@ -197,11 +490,283 @@ type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
+func (s *grpcServer) ListMembers(
+	ctx context.Context, req *api.ListMembersRequest,
+) (*api.ListMembersResponse, error) {
+	if s.MemberLister == nil {
+		return nil, status.Error(codes.Unimplemented, "members not supported")
+	}
+	members, err := s.MemberLister.ListMembers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListMembersResponse{Members: members}, nil
+}
+
+// MemberLister lists the servers known to the gossip or Raft.
+type MemberLister interface {
+	ListMembers() ([]*api.Member, error)
+}
+
+func (s *grpcServer) WatchCluster(
+	req *api.WatchClusterRequest,
+	stream api.Log_WatchClusterServer,
+) error {
+	watcher, err := s.clusterWatcher(req.Partition)
+	if err != nil {
+		return err
+	}
+	events, cancel, err := watcher.WatchCluster()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type ClusterWatcher interface {
+	WatchCluster() (<-chan *api.ClusterEvent, func(), error)
+}
+
+type adminServer struct {
+	*Config
+	*api.UnimplementedAdminServer
+}
+
+// authorize checks the caller may administer the cluster and returns the
+// partition's administrator.
+func (s *adminServer) authorize(
+	ctx context.Context,
+	partition uint32,
+) (Administrator, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+	return s.administrator(partition)
+}
+
+func (s *adminServer) TransferLeadership(
+	ctx context.Context, req *api.TransferLeadershipRequest,
+) (
+	*api.TransferLeadershipResponse, error) {
+	admin, err := s.authorize(ctx, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	err = admin.TransferLeadership(req.Id, req.RpcAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &api.TransferLeadershipResponse{}, nil
+}
+
+func (s *adminServer) RemoveServer(
+	ctx context.Context, req *api.RemoveServerRequest,
+) (
+	*api.RemoveServerResponse, error) {
+	admin, err := s.authorize(ctx, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err := admin.RemoveServer(req.Id); err != nil {
+		return nil, err
+	}
+	return &api.RemoveServerResponse{}, nil
+}
+
+func (s *adminServer) AddVoter(
+	ctx context.Context, req *api.AddServerRequest,
+) (
+	*api.AddServerResponse, error) {
+	admin, err := s.authorize(ctx, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err := admin.AddVoter(req.Id, req.RpcAddr); err != nil {
+		return nil, err
+	}
+	return &api.AddServerResponse{}, nil
+}
+
+func (s *adminServer) AddNonvoter(
+	ctx context.Context, req *api.AddServerRequest,
+) (
+	*api.AddServerResponse, error) {
+	admin, err := s.authorize(ctx, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err := admin.AddNonvoter(req.Id, req.RpcAddr); err != nil {
+		return nil, err
+	}
+	return &api.AddServerResponse{}, nil
+}
+
+func (s *adminServer) Snapshot(
+	ctx context.Context, req *api.SnapshotRequest,
+) (
+	*api.SnapshotResponse, error) {
+	admin, err := s.authorize(ctx, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return admin.Snapshot()
+}
+
+func (s *adminServer) RaftStats(
+	ctx context.Context, req *api.RaftStatsRequest,
+) (
+	*api.RaftStatsResponse, error) {
+	admin, err := s.authorize(ctx, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return admin.RaftStats()
+}
+
+// keyring checks the caller may administer the cluster and returns the
+// keyring.
+func (s *adminServer) keyring(ctx context.Context) (Keyring, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Keyring == nil {
+		return nil, status.Error(codes.Unimplemented, "keyring not supported")
+	}
+	return s.Keyring, nil
+}
+
+func (s *adminServer) InstallKey(
+	ctx context.Context, req *api.KeyRequest,
+) (
+	*api.KeyResponse, error) {
+	keyring, err := s.keyring(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := keyring.InstallKey(req.Key); err != nil {
+		return nil, err
+	}
+	return &api.KeyResponse{}, nil
+}
+
+func (s *adminServer) UseKey(
+	ctx context.Context, req *api.KeyRequest,
+) (
+	*api.KeyResponse, error) {
+	keyring, err := s.keyring(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := keyring.UseKey(req.Key); err != nil {
+		return nil, err
+	}
+	return &api.KeyResponse{}, nil
+}
+
+func (s *adminServer) RemoveKey(
+	ctx context.Context, req *api.KeyRequest,
+) (
+	*api.KeyResponse, error) {
+	keyring, err := s.keyring(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := keyring.RemoveKey(req.Key); err != nil {
+		return nil, err
+	}
+	return &api.KeyResponse{}, nil
+}
+
+func (s *adminServer) ListKeys(
+	ctx context.Context, req *api.ListKeysRequest,
+) (
+	*api.ListKeysResponse, error) {
+	keyring, err := s.keyring(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := keyring.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	res := &api.ListKeysResponse{Keys: make(map[string]int32, len(keys))}
+	for key, n := range keys {
+		res.Keys[key] = int32(n)
+	}
+	return res, nil
+}
+
+type Administrator interface {
+	TransferLeadership(id, addr string) error
+	RemoveServer(id string) error
+	AddVoter(id, addr string) error
+	AddNonvoter(id, addr string) error
+	Snapshot() (*api.SnapshotResponse, error)
+	RaftStats() (*api.RaftStatsResponse, error)
+}
+
+// Keyring installs, uses and removes the base64 encoded keys that encrypt
+// the gossip on every member, and lists the members' keys.
+type Keyring interface {
+	InstallKey(key string) error
+	UseKey(key string) error
+	RemoveKey(key string) error
+	ListKeys() (map[string]int, error)
+}
+
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
 }
 
+// ContextAppender is a CommitLog whose appends can be bounded by the
+// request's deadline.
+type ContextAppender interface {
+	AppendContext(context.Context, *api.Record) (uint64, error)
+}
+
+// ProducerAppender is a CommitLog that dedupes the records of idempotent
+// producers by their sequences.
+type ProducerAppender interface {
+	AppendProducer(
+		ctx context.Context,
+		producerID string,
+		sequence uint64,
+		record *api.Record,
+	) (uint64, error)
+}
+
+// OffsetGetter is a CommitLog that reports its range of offsets.
+type OffsetGetter interface {
+	GetOffsets() (*api.GetOffsetsResponse, error)
+}
+
+type OffsetStore interface {
+	CommitOffset(ctx context.Context, group string, offset uint64) error
+	FetchOffset(group string) (uint64, error)
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
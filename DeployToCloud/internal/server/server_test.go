@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"io"
 	"net"
 	"os"
 	"testing"
@@ -43,10 +45,15 @@ func TestServer(t *testing.T) {
 		nobodyClient api.LogClient,
 		config *Config,
 	){
-		"produce/consume a message to/from the log succeeds": testProduceConsume,
-		"produce/consume stream succeeds":                    testProduceConsumeStream,
-		"consume past log boundary fails":                    testConsumePastBoundary,
-		"unauthorized fails":                                 testUnauthorized,
+		"produce/consume a message to/from the log succeeds":  testProduceConsume,
+		"produce/consume stream succeeds":                     testProduceConsumeStream,
+		"consume past log boundary fails":                     testConsumePastBoundary,
+		"unauthorized fails":                                  testUnauthorized,
+		"commit/fetch a consumer group offset succeeds":       testCommitFetchOffset,
+		"produce/consume to/from a partition succeeds":        testPartitions,
+		"consume stream in batches to an end offset succeeds": testConsumeStreamBatches,
+		"get offsets succeeds":                                testGetOffsets,
+		"consume stream read errors fail":                     testConsumeStreamErrors,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient,
@@ -140,8 +147,9 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	}
 
 	cfg = &Config{
-		CommitLog:  cl,
-		Authorizer: a,
+		CommitLog:   cl,
+		Authorizer:  a,
+		OffsetStore: &offsetStore{offsets: make(map[string]uint64)},
 	}
 	if fn != nil {
 		fn(cfg)
@@ -217,6 +225,44 @@ func testConsumePastBoundary(
 	}
 }
 
+func testPartitions(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	partition, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	config.Partitions = []CommitLog{config.CommitLog, partition}
+
+	want := &api.Record{Value: []byte("hello world")}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record:    want,
+		Partition: 1,
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:    produce.Offset,
+		Partition: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+
+	// partition 0 is still empty
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.Error(t, err)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:    want,
+		Partition: 2,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
 func testProduceConsumeStream(
 	t *testing.T,
 	client, _ api.LogClient,
@@ -272,6 +318,157 @@ func testProduceConsumeStream(
 	}
 }
 
+func testConsumeStreamBatches(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("0123456789")},
+		})
+		require.NoError(t, err)
+	}
+
+	// recvBatches reads the stream until it ends and returns the offsets
+	// of every batch
+	recvBatches := func(req *api.ConsumeRequest) [][]uint64 {
+		stream, err := client.ConsumeStream(ctx, req)
+		require.NoError(t, err)
+		var batches [][]uint64
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return batches
+			}
+			require.NoError(t, err)
+			var batch []uint64
+			for _, record := range res.Records {
+				batch = append(batch, record.Offset)
+			}
+			batches = append(batches, batch)
+		}
+	}
+	end := uint64(5)
+	require.Equal(t, [][]uint64{{0, 1}, {2, 3}, {4}}, recvBatches(
+		&api.ConsumeRequest{Batch: true, MaxRecords: 2, EndOffset: &end},
+	))
+	// a batch stops before the record that would take it past max bytes
+	require.Equal(t, [][]uint64{{1, 2}, {3, 4}}, recvBatches(
+		&api.ConsumeRequest{
+			Offset:    1,
+			Batch:     true,
+			MaxBytes:  25,
+			EndOffset: &end,
+		},
+	))
+	// a record bigger than max bytes is a batch of its own
+	three := uint64(3)
+	require.Equal(t, [][]uint64{{0}, {1}, {2}}, recvBatches(
+		&api.ConsumeRequest{Batch: true, MaxBytes: 1, EndOffset: &three},
+	))
+
+	// without batches the records come one per response
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:    3,
+		EndOffset: &end,
+	})
+	require.NoError(t, err)
+	for i := uint64(3); i < end; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, res.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: 2,
+		Batch:  true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(consume.Records))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 5, Batch: true})
+	require.Equal(
+		t,
+		status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()),
+		status.Code(err),
+	)
+}
+
+func testConsumeStreamErrors(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 32
+	truncated, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := truncated.Append(&api.Record{Value: []byte("0123456789")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, truncated.Truncate(2))
+	config.Partitions = []CommitLog{
+		config.CommitLog,
+		truncated,
+		&unreadableLog{CommitLog: config.CommitLog},
+	}
+
+	// the records before the lowest offset won't ever come
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Partition: 1,
+		Batch:     true,
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}), status.Code(err))
+
+	// the log's errors aren't taken for its end
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Partition: 2,
+		Batch:     true,
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unknown, status.Code(err))
+	require.Contains(t, err.Error(), "disk failure")
+}
+
+func testGetOffsets(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.LowestOffset)
+	require.Equal(t, uint64(2), offsets.HighestOffset)
+	require.Equal(t, uint64(3), offsets.NextOffset)
+	// the log isn't replicated with Raft
+	require.Equal(t, uint64(0), offsets.CommitIndex)
+
+	_, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{Partition: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
 func testUnauthorized(
 	t *testing.T,
 	_,
@@ -305,6 +502,100 @@ func testUnauthorized(
 	}
 }
 
+func testCommitFetchOffset(
+	t *testing.T,
+	client, nobodyClient api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	_, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "group",
+		Offset: 2,
+	})
+	require.NoError(t, err)
+
+	res, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Offset)
+
+	_, err = nobodyClient.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "group",
+		Offset: 3,
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// every partition stores its own groups' offsets
+	config.Partitions = []CommitLog{
+		config.CommitLog,
+		&offsetLog{
+			CommitLog:   config.CommitLog,
+			offsetStore: &offsetStore{offsets: make(map[string]uint64)},
+		},
+		config.CommitLog,
+	}
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:     "group",
+		Offset:    5,
+		Partition: 1,
+	})
+	require.NoError(t, err)
+	res, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group:     "group",
+		Partition: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), res.Offset)
+	res, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Offset)
+
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group:     "group",
+		Partition: 2,
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+// unreadableLog fails every read.
+type unreadableLog struct {
+	CommitLog
+}
+
+func (l *unreadableLog) Read(uint64) (*api.Record, error) {
+	return nil, errors.New("disk failure")
+}
+
+// offsetLog is a partition's log that stores its groups' offsets.
+type offsetLog struct {
+	CommitLog
+	*offsetStore
+}
+
+type offsetStore struct {
+	offsets map[string]uint64
+}
+
+func (s *offsetStore) CommitOffset(
+	_ context.Context,
+	group string,
+	offset uint64,
+) error {
+	s.offsets[group] = offset
+	return nil
+}
+
+func (s *offsetStore) FetchOffset(group string) (uint64, error) {
+	offset, ok := s.offsets[group]
+	if !ok {
+		return 0, api.ErrNoCommittedOffset{Group: group}
+	}
+	return offset, nil
+}
+
 func setupTest1(t *testing.T, fn func(*Config)) (
 	client api.LogClient,
 	cfg *Config,
@@ -0,0 +1,156 @@
+// Package client is a Go client for a proglog cluster. Dial connects to the
+// cluster through the proglog resolver and balancer, a Producer batches and
+// retries appends, and a Consumer streams records and tracks its offset.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+	"github.com/igor-baiborodine/proglog/internal/config"
+	"github.com/igor-baiborodine/proglog/internal/loadbalance"
+)
+
+// ErrClosed is returned by the producers and consumers once they're closed.
+var ErrClosed = errors.New("client: closed")
+
+const (
+	defaultBackoff = 100 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+type Config struct {
+	// Addrs are the RPC addresses of the servers to resolve the cluster
+	// from, the client fails over between them.
+	Addrs []string
+	// Zone is the client's zone, reads prefer the followers in it.
+	Zone string
+	// CertFile, KeyFile and CAFile set up the client's TLS, the client
+	// dials without TLS when they're empty and TLSConfig isn't set.
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+	// TLSConfig takes precedence over the files.
+	TLSConfig *tls.Config
+	// Balancer sets the methods' routes and how followers are picked, the
+	// methods it doesn't route keep their default routes.
+	Balancer loadbalance.Config
+	// DialOptions are added to the client's.
+	DialOptions []grpc.DialOption
+}
+
+// Client is a connection to a cluster.
+type Client struct {
+	conn *grpc.ClientConn
+	log  api.LogClient
+}
+
+// Dial connects to the cluster the config's addresses belong to.
+func Dial(c Config) (*Client, error) {
+	if len(c.Addrs) == 0 {
+		return nil, errors.New("client: no addrs")
+	}
+	creds := insecure.NewCredentials()
+	tlsConfig := c.TLSConfig
+	if tlsConfig == nil && (c.CertFile != "" || c.CAFile != "") {
+		var err error
+		tlsConfig, err = config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      c.CertFile,
+			KeyFile:       c.KeyFile,
+			CAFile:        c.CAFile,
+			ServerAddress: c.ServerName,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	target := fmt.Sprintf(
+		"%s:///%s",
+		loadbalance.Name,
+		strings.Join(c.Addrs, ","),
+	)
+	query := c.Balancer.Query()
+	if c.Zone != "" {
+		query.Set("zone", c.Zone)
+	}
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+	opts := append(
+		[]grpc.DialOption{grpc.WithTransportCredentials(creds)},
+		c.DialOptions...,
+	)
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn: conn,
+		log:  api.NewLogClient(conn),
+	}, nil
+}
+
+// Log returns the client for the calls the producers and consumers don't
+// cover.
+func (c *Client) Log() api.LogClient {
+	return c.log
+}
+
+// GetOffsets returns the partition's offsets from its leader.
+func (c *Client) GetOffsets(
+	ctx context.Context,
+	partition uint32,
+) (*api.GetOffsetsResponse, error) {
+	return c.log.GetOffsets(
+		loadbalance.WithPartition(ctx, partition),
+		&api.GetOffsetsRequest{Partition: partition},
+	)
+}
+
+// Close closes the connection, close the client's producers and consumers
+// first.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// retryable reports whether the call may succeed when retried. A server
+// that isn't the leader didn't apply the call, so it's always retried. When
+// the server or the call's deadline went away the call may have been
+// applied, so it's only retried when applying it twice is harmless.
+func retryable(err error, idempotent bool) bool {
+	if api.IsNotLeader(err) {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// nextBackoff doubles the backoff up to maxBackoff.
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
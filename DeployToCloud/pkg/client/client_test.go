@@ -0,0 +1,499 @@
+package client_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+	"github.com/igor-baiborodine/proglog/internal/auth"
+	"github.com/igor-baiborodine/proglog/internal/config"
+	"github.com/igor-baiborodine/proglog/internal/log"
+	"github.com/igor-baiborodine/proglog/internal/server"
+	"github.com/igor-baiborodine/proglog/pkg/client"
+)
+
+func TestProduceConsume(t *testing.T) {
+	commitLog := setupLog(t)
+	addr, _ := setupServer(t, "127.0.0.1:0", commitLog)
+	c := setupClient(t, addr)
+
+	producer, err := c.NewProducer(client.ProducerConfig{BatchSize: 10})
+	require.NoError(t, err)
+	var acks []*client.Ack
+	for i := 0; i < 25; i++ {
+		acks = append(acks, producer.Produce(&api.Record{
+			Value: []byte{byte(i)},
+		}))
+	}
+	for i, ack := range acks {
+		offset, err := ack.Wait(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), offset)
+	}
+	require.NoError(t, producer.Close())
+	require.ErrorIs(t, producer.Produce(&api.Record{}).Err(), client.ErrClosed)
+
+	ctx := context.Background()
+	consumer, err := c.NewConsumer(ctx, client.ConsumerConfig{Group: "group"})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		record := <-consumer.Records()
+		require.Equal(t, uint64(i), record.Offset)
+	}
+	for i := 5; i < 15; i++ {
+		record, err := consumer.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, []byte{byte(i)}, record.Value)
+	}
+	require.Equal(t, uint64(15), consumer.Offset())
+	require.NoError(t, consumer.Close())
+	_, err = consumer.Next(ctx)
+	require.ErrorIs(t, err, client.ErrClosed)
+
+	// the group resumes after the records delivered before closing
+	consumer, err = c.NewConsumer(ctx, client.ConsumerConfig{Group: "group"})
+	require.NoError(t, err)
+	defer consumer.Close()
+	record, err := consumer.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(15), record.Offset)
+}
+
+func TestProducerRetriesNotLeader(t *testing.T) {
+	commitLog := &notLeaderLog{CommitLog: setupLog(t), failures: 3}
+	addr, _ := setupServer(t, "127.0.0.1:0", commitLog)
+	c := setupClient(t, addr)
+
+	producer, err := c.NewProducer(client.ProducerConfig{
+		Backoff: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+	for i := 0; i < 3; i++ {
+		offset, err := producer.Produce(&api.Record{
+			Value: []byte("hello"),
+		}).Wait(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), offset)
+	}
+
+	// without retries the producer gives up on the first failure
+	atomic.StoreInt32(&commitLog.failures, 1)
+	noRetries, err := c.NewProducer(client.ProducerConfig{MaxRetries: -1})
+	require.NoError(t, err)
+	defer noRetries.Close()
+	_, err = noRetries.Produce(&api.Record{
+		Value: []byte("hello"),
+	}).Wait(context.Background())
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.True(t, api.IsNotLeader(err))
+}
+
+func TestProducerDoesNotRetryAmbiguousErrors(t *testing.T) {
+	l := setupLog(t)
+	commitLog := &lostLeadershipLog{CommitLog: l, failures: 1}
+	addr, _ := setupServer(t, "127.0.0.1:0", commitLog)
+	c := setupClient(t, addr)
+
+	// the leader may have replicated the record before it lost the
+	// leadership, so retrying it could append it twice
+	producer, err := c.NewProducer(client.ProducerConfig{
+		Backoff: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+	_, err = producer.Produce(&api.Record{
+		Value: []byte("hello"),
+	}).Wait(context.Background())
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.False(t, api.IsNotLeader(err))
+	// the record was appended once
+	_, err = l.Read(0)
+	require.NoError(t, err)
+	_, err = l.Read(1)
+	require.Error(t, err)
+}
+
+func TestIdempotentProducer(t *testing.T) {
+	commitLog := &sequencedLog{CommitLog: setupLog(t)}
+	addr, _ := setupServer(t, "127.0.0.1:0", commitLog)
+	c := setupClient(t, addr)
+
+	producer, err := c.NewProducer(client.ProducerConfig{
+		BatchSize:  2,
+		Idempotent: true,
+	})
+	require.NoError(t, err)
+	var acks []*client.Ack
+	for i := 0; i < 5; i++ {
+		acks = append(acks, producer.Produce(&api.Record{
+			Value: []byte("hello"),
+		}))
+	}
+	require.NoError(t, producer.Close())
+	for _, ack := range acks {
+		require.NoError(t, ack.Err())
+	}
+
+	// every record has the producer's ID and its next sequence
+	commitLog.mu.Lock()
+	defer commitLog.mu.Unlock()
+	require.Equal(t, 5, len(commitLog.sequences))
+	for i, sequence := range commitLog.sequences {
+		require.NotEmpty(t, commitLog.producerID)
+		require.Equal(t, uint64(i+1), sequence)
+	}
+}
+
+func TestIdempotentProducerDedupesRetries(t *testing.T) {
+	commitLog := &lostAckLog{DistributedLog: setupDistributedLog(t), failures: 1}
+	addr, _ := setupServer(t, "127.0.0.1:0", commitLog)
+	c := setupClient(t, addr)
+
+	// the first attempt appends the first record but its ack is lost, the
+	// retry sends it again and the log returns its original offset
+	producer, err := c.NewProducer(client.ProducerConfig{
+		BatchSize:  3,
+		Backoff:    10 * time.Millisecond,
+		Idempotent: true,
+	})
+	require.NoError(t, err)
+	var acks []*client.Ack
+	for i := 0; i < 3; i++ {
+		acks = append(acks, producer.Produce(&api.Record{
+			Value: []byte("hello"),
+		}))
+	}
+	require.NoError(t, producer.Close())
+	for i, ack := range acks {
+		require.NoError(t, ack.Err())
+		require.Equal(t, uint64(i), ack.Offset())
+	}
+	offsets, err := commitLog.GetOffsets()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offsets.NextOffset)
+
+	// a producer that gave up on a record it never appended doesn't leave
+	// a gap in its sequences
+	atomic.StoreInt32(&commitLog.rejects, 1)
+	noRetries, err := c.NewProducer(client.ProducerConfig{
+		MaxRetries: -1,
+		Idempotent: true,
+	})
+	require.NoError(t, err)
+	defer noRetries.Close()
+	_, err = noRetries.Produce(&api.Record{
+		Value: []byte("hello"),
+	}).Wait(context.Background())
+	require.True(t, api.IsNotLeader(err))
+	offset, err := noRetries.Produce(&api.Record{
+		Value: []byte("hello"),
+	}).Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+}
+
+func TestConsumerReconnects(t *testing.T) {
+	commitLog := setupLog(t)
+	addr, stop := setupServer(t, "127.0.0.1:0", commitLog)
+	c := setupClient(t, addr)
+	for i := 0; i < 3; i++ {
+		_, err := commitLog.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+
+	ctx := context.Background()
+	consumer, err := c.NewConsumer(ctx, client.ConsumerConfig{
+		Backoff: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer consumer.Close()
+	for i := 0; i < 3; i++ {
+		record, err := consumer.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+	}
+
+	// the consumer picks up where it left off once the server's back
+	stop()
+	for i := 3; i < 5; i++ {
+		_, err := commitLog.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+	setupServer(t, addr, commitLog)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	for i := 3; i < 5; i++ {
+		record, err := consumer.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+	}
+}
+
+func TestConsumerEndOffset(t *testing.T) {
+	commitLog := setupLog(t)
+	addr, _ := setupServer(t, "127.0.0.1:0", commitLog)
+	c := setupClient(t, addr)
+	for i := 0; i < 5; i++ {
+		_, err := commitLog.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+
+	ctx := context.Background()
+	end := uint64(3)
+	consumer, err := c.NewConsumer(ctx, client.ConsumerConfig{
+		EndOffset: &end,
+		BatchSize: 2,
+	})
+	require.NoError(t, err)
+	defer consumer.Close()
+	for i := uint64(0); i < end; i++ {
+		record, err := consumer.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, i, record.Offset)
+	}
+	_, err = consumer.Next(ctx)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestConsumerLatest(t *testing.T) {
+	commitLog := setupLog(t)
+	addr, _ := setupServer(t, "127.0.0.1:0", commitLog)
+	c := setupClient(t, addr)
+	for i := 0; i < 3; i++ {
+		_, err := commitLog.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+
+	ctx := context.Background()
+	offsets, err := c.GetOffsets(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offsets.HighestOffset)
+	require.Equal(t, uint64(3), offsets.NextOffset)
+
+	// the consumer only gets the records appended after it started
+	consumer, err := c.NewConsumer(ctx, client.ConsumerConfig{Latest: true})
+	require.NoError(t, err)
+	defer consumer.Close()
+	require.Equal(t, uint64(3), consumer.Offset())
+	_, err = commitLog.Append(&api.Record{Value: []byte{3}})
+	require.NoError(t, err)
+	record, err := consumer.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Offset)
+}
+
+func setupLog(t *testing.T) *log.Log {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "client-test")
+	require.NoError(t, err)
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Remove()
+	})
+	return l
+}
+
+// setupServer serves the log on addr and returns the address it listens
+// on and a func to stop it.
+func setupServer(t *testing.T, addr string, commitLog server.CommitLog) (
+	string,
+	func(),
+) {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:   commitLog,
+		Authorizer:  auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		GetServerer: &getServers{addr: l.Addr().String()},
+		OffsetStore: &offsetStore{offsets: make(map[string]uint64)},
+	}, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String(), srv.Stop
+}
+
+func setupClient(t *testing.T, addr string) *client.Client {
+	t.Helper()
+	c, err := client.Dial(client.Config{
+		Addrs:      []string{addr},
+		CertFile:   config.RootClientCertFile,
+		KeyFile:    config.RootClientKeyFile,
+		CAFile:     config.CAFile,
+		ServerName: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// setupDistributedLog starts a distributed log that leads its cluster of
+// one.
+func setupDistributedLog(t *testing.T) *log.DistributedLog {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "client-test")
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	c := log.Config{}
+	c.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	c.Raft.LocalID = "0"
+	c.Raft.BindAddr = ln.Addr().String()
+	c.Raft.Bootstrap = true
+	c.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	c.Raft.ElectionTimeout = 50 * time.Millisecond
+	c.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	c.Raft.CommitTimeout = 5 * time.Millisecond
+	l, err := log.NewDistributedLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+		_ = os.RemoveAll(dir)
+	})
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+	return l
+}
+
+// getServers is a cluster of the one server at addr.
+type getServers struct {
+	addr string
+}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	return []*api.Server{{
+		Id:       "0",
+		RpcAddr:  s.addr,
+		IsLeader: true,
+	}}, nil
+}
+
+// notLeaderLog fails its appends as a server that lost the leadership until
+// it has no failures left.
+type notLeaderLog struct {
+	server.CommitLog
+	failures int32
+}
+
+func (l *notLeaderLog) Append(record *api.Record) (uint64, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return 0, raft.ErrNotLeader
+	}
+	return l.CommitLog.Append(record)
+}
+
+// lostLeadershipLog appends the records but fails as a leader that lost
+// the leadership before they committed until it has no failures left.
+type lostLeadershipLog struct {
+	server.CommitLog
+	failures int32
+}
+
+func (l *lostLeadershipLog) Append(record *api.Record) (uint64, error) {
+	offset, err := l.CommitLog.Append(record)
+	if err == nil && atomic.AddInt32(&l.failures, -1) >= 0 {
+		return 0, raft.ErrLeadershipLost
+	}
+	return offset, err
+}
+
+// lostAckLog rejects the idempotent producers' records as a follower until
+// it has no rejects left. Then it appends them, but fails as a leader that
+// lost the leadership after replicating them until it has no failures left.
+type lostAckLog struct {
+	*log.DistributedLog
+	rejects  int32
+	failures int32
+}
+
+func (l *lostAckLog) AppendProducer(
+	ctx context.Context,
+	producerID string,
+	sequence uint64,
+	record *api.Record,
+) (uint64, error) {
+	if atomic.AddInt32(&l.rejects, -1) >= 0 {
+		return 0, raft.ErrNotLeader
+	}
+	offset, err := l.DistributedLog.AppendProducer(
+		ctx,
+		producerID,
+		sequence,
+		record,
+	)
+	if err == nil && atomic.AddInt32(&l.failures, -1) >= 0 {
+		return 0, raft.ErrLeadershipLost
+	}
+	return offset, err
+}
+
+// sequencedLog records the idempotent producer's sequences.
+type sequencedLog struct {
+	server.CommitLog
+	mu         sync.Mutex
+	producerID string
+	sequences  []uint64
+}
+
+func (l *sequencedLog) AppendProducer(
+	_ context.Context,
+	producerID string,
+	sequence uint64,
+	record *api.Record,
+) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.producerID = producerID
+	l.sequences = append(l.sequences, sequence)
+	return l.CommitLog.Append(record)
+}
+
+type offsetStore struct {
+	mu      sync.Mutex
+	offsets map[string]uint64
+}
+
+func (s *offsetStore) CommitOffset(
+	_ context.Context,
+	group string,
+	offset uint64,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets[group] = offset
+	return nil
+}
+
+func (s *offsetStore) FetchOffset(group string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok := s.offsets[group]
+	if !ok {
+		return 0, api.ErrNoCommittedOffset{Group: group}
+	}
+	return offset, nil
+}
@@ -0,0 +1,268 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+	"github.com/igor-baiborodine/proglog/internal/loadbalance"
+)
+
+type ConsumerConfig struct {
+	// Partition is the partition the consumer reads.
+	Partition uint32
+	// Group is the consumer group the consumer commits its offset for. The
+	// consumer starts from the group's committed offset for the partition
+	// when it has one.
+	Group string
+	// Offset is where the consumer starts without a committed offset.
+	Offset uint64
+	// Latest starts the consumer after the partition's last record, instead
+	// of from Offset, when it has no committed offset.
+	Latest bool
+	// EndOffset ends the consumer once it has delivered the records before
+	// it, the consumer otherwise waits for new records until it's closed.
+	EndOffset *uint64
+	// BatchSize is the most records the server sends at once, 100 by
+	// default.
+	BatchSize uint64
+	// Backoff is how long the first reconnect waits, it doubles with every
+	// failed reconnect, 100ms by default.
+	Backoff time.Duration
+	// CommitTimeout bounds the commit when the consumer closes, 5s by
+	// default.
+	CommitTimeout time.Duration
+}
+
+// Consumer streams a partition's records from its offset. When the stream
+// fails it reconnects from the record after the last one it delivered, so
+// the records are delivered once and in order.
+type Consumer struct {
+	client *Client
+	config ConsumerConfig
+
+	mu sync.Mutex
+	// offset is the next offset to deliver.
+	offset uint64
+	err    error
+	// ended is set once the records before the end offset are delivered.
+	ended bool
+
+	records chan *api.Record
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewConsumer starts a consumer from its group's committed offset, or from
+// the config's offset or the partition's next one.
+func (c *Client) NewConsumer(
+	ctx context.Context,
+	config ConsumerConfig,
+) (*Consumer, error) {
+	if config.Backoff <= 0 {
+		config.Backoff = defaultBackoff
+	}
+	if config.CommitTimeout <= 0 {
+		config.CommitTimeout = 5 * time.Second
+	}
+	offset := config.Offset
+	committed := false
+	if config.Group != "" {
+		res, err := c.log.FetchOffset(
+			loadbalance.WithPartition(ctx, config.Partition),
+			&api.FetchOffsetRequest{
+				Group:     config.Group,
+				Partition: config.Partition,
+			},
+		)
+		switch {
+		case err == nil:
+			offset = res.Offset
+			committed = true
+		case status.Code(err) != codes.NotFound:
+			return nil, err
+		}
+	}
+	if config.Latest && !committed {
+		res, err := c.GetOffsets(ctx, config.Partition)
+		if err != nil {
+			return nil, err
+		}
+		offset = res.NextOffset
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &Consumer{
+		client:  c,
+		config:  config,
+		offset:  offset,
+		records: make(chan *api.Record),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go consumer.run(ctx)
+	return consumer, nil
+}
+
+// Records returns the channel the records are delivered on, it's closed
+// when the consumer closes, fails or reaches its end offset.
+func (c *Consumer) Records() <-chan *api.Record {
+	return c.records
+}
+
+// Next returns the next record, waiting for it to be appended. It returns
+// io.EOF once the consumer reaches its end offset, ErrClosed once it's
+// closed, or the error it failed with.
+func (c *Consumer) Next(ctx context.Context) (*api.Record, error) {
+	select {
+	case record, ok := <-c.records:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.err != nil {
+				return nil, c.err
+			}
+			if c.ended {
+				return nil, io.EOF
+			}
+			return nil, ErrClosed
+		}
+		// set the offset here too, so it follows the record as soon as
+		// Next returns it
+		c.setOffset(record.Offset + 1)
+		return record, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Offset returns the offset of the next record the consumer delivers. A
+// record received from Records counts once the consumer sends the next one.
+func (c *Consumer) Offset() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset
+}
+
+// Err returns the error the consumer stopped with, nil if it's running or
+// was closed.
+func (c *Consumer) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Commit commits the consumer's offset for its group, so the group resumes
+// after the records delivered so far.
+func (c *Consumer) Commit(ctx context.Context) error {
+	if c.config.Group == "" {
+		return errors.New("client: consumer has no group")
+	}
+	_, err := c.client.log.CommitOffset(
+		loadbalance.WithPartition(ctx, c.config.Partition),
+		&api.CommitOffsetRequest{
+			Group:     c.config.Group,
+			Offset:    c.Offset(),
+			Partition: c.config.Partition,
+		},
+	)
+	return err
+}
+
+// Close stops the consumer and commits its offset when it has a group.
+func (c *Consumer) Close() error {
+	c.cancel()
+	<-c.done
+	if c.config.Group == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		c.config.CommitTimeout,
+	)
+	defer cancel()
+	return c.Commit(ctx)
+}
+
+// run streams the records from the consumer's offset, reconnecting with a
+// backoff when the stream fails with a retryable error.
+func (c *Consumer) run(ctx context.Context) {
+	defer close(c.done)
+	defer close(c.records)
+	backoff := c.config.Backoff
+	for {
+		err := c.consume(ctx, func() { backoff = c.config.Backoff })
+		if ctx.Err() != nil {
+			return
+		}
+		if err == io.EOF {
+			c.mu.Lock()
+			c.ended = true
+			c.mu.Unlock()
+			return
+		}
+		// reading the records again is harmless
+		if !retryable(err, true) {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// consume delivers the records of one stream until it fails or ends,
+// calling delivered after each record. It returns io.EOF once the records
+// before the end offset are delivered.
+func (c *Consumer) consume(ctx context.Context, delivered func()) error {
+	stream, err := c.client.log.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:     c.Offset(),
+		Partition:  c.config.Partition,
+		Batch:      true,
+		MaxRecords: c.config.BatchSize,
+		EndOffset:  c.config.EndOffset,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			if end := c.config.EndOffset; end != nil && c.Offset() >= *end {
+				return io.EOF
+			}
+			// the server ended the stream, e.g. because it's shutting down
+			return status.Error(codes.Unavailable, "stream ended")
+		}
+		if err != nil {
+			return err
+		}
+		for _, record := range res.Records {
+			select {
+			case c.records <- record:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			c.setOffset(record.Offset + 1)
+			delivered()
+		}
+	}
+}
+
+// setOffset sets the next offset to deliver.
+func (c *Consumer) setOffset(offset uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset = offset
+}
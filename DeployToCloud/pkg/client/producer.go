@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/igor-baiborodine/proglog/api/v1"
+	"github.com/igor-baiborodine/proglog/internal/loadbalance"
+)
+
+type ProducerConfig struct {
+	// Partition is the partition the producer appends to.
+	Partition uint32
+	// BatchSize is the most records sent together, 100 by default.
+	BatchSize int
+	// Linger is how long a batch waits for more records before it's sent,
+	// 5ms by default.
+	Linger time.Duration
+	// MaxRetries is how many times a batch is retried after retryable
+	// errors, like the server not being the leader, 10 by default and none
+	// when it's negative. Records that may have been appended, e.g. when
+	// the connection broke before their acks, are only retried by
+	// idempotent producers.
+	MaxRetries int
+	// Backoff is how long the first retry waits, it doubles with every
+	// retry, 100ms by default.
+	Backoff time.Duration
+	// Timeout bounds every attempt to send a batch, 10s by default.
+	Timeout time.Duration
+	// Idempotent gives the producer an ID and its records sequences, so
+	// the records retried after their acks were lost aren't appended twice.
+	Idempotent bool
+}
+
+// Producer appends records to a partition. It sends the records in
+// batches over a ProduceStream to the partition's leader, and retries the
+// records that weren't appended when the leader changes.
+type Producer struct {
+	client *Client
+	config ProducerConfig
+
+	mu      sync.RWMutex
+	closed  bool
+	records chan *Ack
+	done    chan struct{}
+
+	// id is the idempotent producer's ID and sequence its last sent
+	// record's sequence, they're only used by run.
+	id       string
+	sequence uint64
+}
+
+// NewProducer starts a producer that appends to the config's partition.
+func (c *Client) NewProducer(config ProducerConfig) (*Producer, error) {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.Linger <= 0 {
+		config.Linger = 5 * time.Millisecond
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 10
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultBackoff
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	p := &Producer{
+		client:  c,
+		config:  config,
+		records: make(chan *Ack, config.BatchSize),
+		done:    make(chan struct{}),
+	}
+	if config.Idempotent {
+		id, err := newProducerID()
+		if err != nil {
+			return nil, err
+		}
+		p.id = id
+	}
+	go p.run()
+	return p, nil
+}
+
+func newProducerID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Ack is the outcome of producing a record, it's done once the record is
+// appended or the producer gave up on it.
+type Ack struct {
+	record   *api.Record
+	sequence uint64
+	offset   uint64
+	err      error
+	done     chan struct{}
+}
+
+func newAck(record *api.Record) *Ack {
+	return &Ack{record: record, done: make(chan struct{})}
+}
+
+func (a *Ack) complete(offset uint64, err error) {
+	a.offset = offset
+	a.err = err
+	close(a.done)
+}
+
+// Done is closed once the ack's offset and error are set.
+func (a *Ack) Done() <-chan struct{} {
+	return a.done
+}
+
+// Offset is the record's offset, set once the ack is done.
+func (a *Ack) Offset() uint64 {
+	<-a.done
+	return a.offset
+}
+
+// Err is why the record wasn't appended, set once the ack is done. For an
+// idempotent producer's record it's an AlreadyExists status when an attempt
+// whose ack was lost appended the record, its offset is then unknown.
+func (a *Ack) Err() error {
+	<-a.done
+	return a.err
+}
+
+// Wait waits for the ack, or for the context to be done.
+func (a *Ack) Wait(ctx context.Context) (uint64, error) {
+	select {
+	case <-a.done:
+		return a.offset, a.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Produce queues the record to be appended and returns its ack without
+// waiting for it. Produce blocks while the queue is full.
+func (p *Producer) Produce(record *api.Record) *Ack {
+	ack := newAck(record)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		ack.complete(0, ErrClosed)
+		return ack
+	}
+	p.records <- ack
+	return ack
+}
+
+// Close sends the queued records, waiting for their acks, and stops the
+// producer.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.records)
+	p.mu.Unlock()
+	<-p.done
+	return nil
+}
+
+// run batches the queued records, sending a batch once it's full or has
+// lingered. One batch is sent at a time, so the records are appended in the
+// order they were produced.
+func (p *Producer) run() {
+	defer close(p.done)
+	timer := time.NewTimer(p.config.Linger)
+	timer.Stop()
+	var batch []*Ack
+	for {
+		select {
+		case ack, ok := <-p.records:
+			if !ok {
+				p.send(batch)
+				return
+			}
+			batch = append(batch, ack)
+			if len(batch) == 1 {
+				timer.Reset(p.config.Linger)
+			}
+			if len(batch) < p.config.BatchSize {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		}
+		p.send(batch)
+		batch = nil
+	}
+}
+
+// send sends the batch, retrying the records that weren't appended until
+// they are, the error isn't retryable or the retries run out. An idempotent
+// producer's records get their sequences as they're sent.
+func (p *Producer) send(batch []*Ack) {
+	if p.id != "" {
+		for _, ack := range batch {
+			p.sequence++
+			ack.sequence = p.sequence
+		}
+	}
+	backoff := p.config.Backoff
+	for retries := 0; len(batch) != 0; retries++ {
+		n, sent, err := p.sendBatch(batch)
+		batch = batch[n:]
+		if err == nil {
+			continue
+		}
+		// an earlier attempt appended the record but its ack was lost, the
+		// records after it may not have been
+		if status.Code(err) == codes.AlreadyExists {
+			batch[0].complete(0, err)
+			batch = batch[1:]
+			continue
+		}
+		// the records that weren't sent can't have been appended
+		idempotent := p.config.Idempotent || !sent
+		if !retryable(err, idempotent) || retries >= p.config.MaxRetries {
+			for _, ack := range batch {
+				ack.complete(0, err)
+			}
+			p.resetSequences()
+			return
+		}
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// resetSequences starts an idempotent producer's sequences over with a new
+// ID after it gave up on records. The server may have appended some of
+// them, so their sequences can neither be sent again nor skipped. The old
+// ID is kept if a new one can't be made.
+func (p *Producer) resetSequences() {
+	if p.id == "" {
+		return
+	}
+	if id, err := newProducerID(); err == nil {
+		p.id = id
+		p.sequence = 0
+	}
+}
+
+// sendBatch sends the batch over a ProduceStream and acks the records as
+// their offsets come back. It returns how many records were appended, and
+// whether the records after them were sent and may have been appended.
+func (p *Producer) sendBatch(batch []*Ack) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(
+		loadbalance.WithPartition(context.Background(), p.config.Partition),
+		p.config.Timeout,
+	)
+	defer cancel()
+	stream, err := p.client.log.ProduceStream(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	go func() {
+		for _, ack := range batch {
+			err := stream.Send(&api.ProduceRequest{
+				Record:     ack.record,
+				Partition:  p.config.Partition,
+				ProducerId: p.id,
+				Sequence:   ack.sequence,
+			})
+			// the stream failed, Recv returns why
+			if err != nil {
+				return
+			}
+		}
+		_ = stream.CloseSend()
+	}()
+	for i, ack := range batch {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return i, true, err
+		}
+		ack.complete(res.Offset, nil)
+	}
+	return len(batch), true, nil
+}